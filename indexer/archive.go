@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// isArchive reports whether the input is a tar, tar.gz or zip archive, which is read without extracting it
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveEntries calls fn with the in-archive path and contents of every regular file of the archive, in
+// archive order, skipping Maildir tmp directories and dotfiles. Tar archives are read sequentially, so nothing
+// is extracted to disk.
+func archiveEntries(ctx context.Context, archive string, fn func(name string, r io.Reader) error) error {
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		reader, err := zip.OpenReader(archive)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		for _, file := range reader.File {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !file.Mode().IsRegular() || skipArchivePath(file.Name) {
+				continue
+			}
+			entry, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(file.Name, entry)
+			entry.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if lower := strings.ToLower(archive); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	reader := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !header.FileInfo().Mode().IsRegular() || skipArchivePath(header.Name) {
+			continue
+		}
+		if err := fn(header.Name, reader); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveMessages calls fn with every email of the archive: the contents of a regular file, or the messages of an
+// mbox file with their sections, according to the format
+func archiveMessages(ctx context.Context, archive, format string, fn func(name string, section mboxSection, data []byte) error) error {
+	return archiveEntries(ctx, archive, func(name string, r io.Reader) error {
+		reader := bufio.NewReader(r)
+		mbox := format == FormatMbox
+		if format == FormatAuto {
+			prefix, _ := reader.Peek(len(mboxSeparator))
+			mbox = bytes.Equal(prefix, mboxSeparator)
+		}
+		if !mbox {
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+			return fn(name, mboxSection{}, data)
+		}
+		return scanMbox(reader, name, true, func(section mboxSection, data []byte) error {
+			return fn(name, section, data)
+		})
+	})
+}
+
+// archiveSource returns a batch source that streams the emails of an archive in batches of batchSize. The emails
+// are read while the archive is decompressed, so their contents travel with the batch.
+func archiveSource(archive, format string, batchSize int) batchSource {
+	return func(ctx context.Context, batches chan<- batch) error {
+		current := batch{}
+		send := func() error {
+			select {
+			case batches <- current:
+				current = batch{seq: current.seq + 1}
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err := archiveMessages(ctx, archive, format, func(name string, section mboxSection, data []byte) error {
+			current.paths = append(current.paths, name)
+			current.sections = append(current.sections, section)
+			current.contents = append(current.contents, data)
+			if len(current.paths) == batchSize {
+				return send()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(current.paths) > 0 {
+			return send()
+		}
+		return nil
+	}
+}
+
+// countArchiveMessages returns the number of emails in the archive, which is read entirely to count them
+func countArchiveMessages(archive, format string) (int, error) {
+	count := 0
+	err := archiveMessages(context.Background(), archive, format, func(string, mboxSection, []byte) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
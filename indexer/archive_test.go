@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testArchiveFiles are the files written to the test archives, in order
+var testArchiveFiles = []struct {
+	name     string
+	contents string
+}{
+	{"maildir/allen-p/inbox/1.", "Message-ID: <a@example.com>\nFrom: allen@example.com\nSubject: Inbox\n\nfirst"},
+	{"maildir/allen-p/sent/1.", "Message-ID: <b@example.com>\nFrom: allen@example.com\nSubject: Sent\n\nsecond"},
+	{"exports/archive.mbox", testMbox},
+}
+
+// writeTestTarGz writes the test files, with their directories, to a tar.gz archive in dir and returns its path
+func writeTestTarGz(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "emails.tar.gz")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("error creating archive: %v", err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "maildir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, f := range testArchiveFiles {
+		tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.contents))})
+		tw.Write([]byte(f.contents))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("error writing archive: %v", err)
+	}
+	gz.Close()
+	return path
+}
+
+// writeTestZip writes the test files, with their directories, to a zip archive in dir and returns its path
+func writeTestZip(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "emails.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("error creating archive: %v", err)
+	}
+	defer file.Close()
+	zw := zip.NewWriter(file)
+	zw.Create("maildir/")
+	for _, f := range testArchiveFiles {
+		w, _ := zw.Create(f.name)
+		w.Write([]byte(f.contents))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("error writing archive: %v", err)
+	}
+	return path
+}
+
+func TestIsArchive(t *testing.T) {
+	tests := map[string]bool{
+		"enron.tar.gz":    true,
+		"enron.TGZ":       true,
+		"enron.tar":       true,
+		"export.zip":      true,
+		"maildir":         false,
+		"archive.mbox":    false,
+		"maildir/1.":      false,
+		"enron.gz.backup": false,
+	}
+	for path, expected := range tests {
+		if got := isArchive(path); got != expected {
+			t.Errorf("isArchive(%s) = %v, expected: %v", path, got, expected)
+		}
+	}
+}
+
+func TestArchiveSource(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(tempDir)
+
+	for _, archive := range []string{writeTestTarGz(t, tempDir), writeTestZip(t, tempDir)} {
+		batches := make(chan batch, 10)
+		if err := archiveSource(archive, FormatAuto, 2)(context.Background(), batches); err != nil {
+			t.Fatalf("archiveSource(%s) returned an error: %v", filepath.Base(archive), err)
+		}
+		close(batches)
+		var emails []*EmailJson
+		for b := range batches {
+			emails = append(emails, parseBatch(b, false, nil)...)
+		}
+
+		// The two single emails and the three messages of the mbox
+		if len(emails) != 5 {
+			t.Fatalf("archiveSource(%s) did not stream every email. Got: %d, expected: 5", filepath.Base(archive), len(emails))
+		}
+		if emails[0].SourcePath != "maildir/allen-p/inbox/1." || emails[0].Body != "first" || emails[0].SourceOffset != nil {
+			t.Errorf("archiveSource(%s) did not keep the in-archive path. Got: %s, %q", filepath.Base(archive), emails[0].SourcePath, emails[0].Body)
+		}
+		if mbox := emails[3]; mbox.SourcePath != "exports/archive.mbox" || mbox.SourceOffset == nil || mbox.Subject != "Second" {
+			t.Errorf("archiveSource(%s) did not split the mbox entry. Got: %s, %v, %s", filepath.Base(archive), mbox.SourcePath, mbox.SourceOffset, mbox.Subject)
+		}
+
+		if count, err := countArchiveMessages(archive, FormatAuto); err != nil || count != 5 {
+			t.Errorf("countArchiveMessages(%s) did not count every email. Got: %d, %v", filepath.Base(archive), count, err)
+		}
+	}
+}
+
+func TestArchiveSourceMaildirFormat(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(tempDir)
+	archive := writeTestTarGz(t, tempDir)
+
+	// With the maildir format the mbox entry is read as a single email
+	if count, err := countArchiveMessages(archive, FormatMaildir); err != nil || count != 3 {
+		t.Errorf("countArchiveMessages did not read every entry as a single email. Got: %d, %v", count, err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	// OversizedTruncate cuts the body of a document that does not fit in a batch
+	OversizedTruncate = "truncate"
+	// OversizedReject leaves out a document that does not fit in a batch
+	OversizedReject = "reject"
+)
+
+// countingWriter counts the bytes written to it and discards them
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// encodedSize returns the size of v encoded as JSON, without keeping the encoding in memory
+func encodedSize(v interface{}) int {
+	counter := &countingWriter{}
+	if err := json.NewEncoder(counter).Encode(v); err != nil {
+		return 0
+	}
+	// The encoder appends a newline that is not part of the payload
+	return counter.n - 1
+}
+
+// payloadOverhead returns the size of the bulk payload around its records
+func payloadOverhead(index string) int {
+	return encodedSize(map[string]interface{}{"index": index, "records": []struct{}{}})
+}
+
+// payloadLayout describes the size of the payload a sink sends for a batch
+type payloadLayout struct {
+	// overhead is the size of a payload without records
+	overhead int
+	// separator is the size between two records
+	separator int
+	// record returns the size of the record of an email
+	record func(email *EmailJson) int
+}
+
+// payloadLayouter is implemented by the sinks that do not send the Zinc bulk payload
+type payloadLayouter interface {
+	PayloadLayout() payloadLayout
+}
+
+// zincLayout returns the layout of the Zinc bulk payload for the index, a JSON array of records
+func zincLayout(index string) payloadLayout {
+	return payloadLayout{overhead: payloadOverhead(index), separator: 1, record: func(email *EmailJson) int { return encodedSize(email) }}
+}
+
+// sinkLayout returns the layout of the payloads of the sink, the Zinc bulk payload for the index unless the
+// sink has its own
+func sinkLayout(sink Sink, index string) payloadLayout {
+	if layouter, ok := sink.(payloadLayouter); ok {
+		return layouter.PayloadLayout()
+	}
+	return zincLayout(index)
+}
+
+// fitDocument makes the email fit in a payload of maxBytes with the layout, according to the policy. With the truncate
+// policy the body is cut at a UTF-8 boundary until the document fits. It returns an error if the email
+// is rejected, or if it still does not fit once the body is empty.
+func fitDocument(email *EmailJson, layout payloadLayout, maxBytes int, policy string) error {
+	limit := maxBytes - layout.overhead
+	size := layout.record(email)
+	if size <= limit {
+		return nil
+	}
+	if policy != OversizedTruncate {
+		return fmt.Errorf("document of %d bytes exceeds the batch limit of %d bytes", size, maxBytes)
+	}
+
+	// The encoded body may be longer than the raw one because of escaping, so shrink until it fits
+	email.Truncated = true
+	size = layout.record(email)
+	body := email.Body
+	for size > limit && body != "" {
+		cut := len(body) - (size - limit)
+		if cut >= len(body) || cut < 0 {
+			cut = len(body) / 2
+		}
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut--
+		}
+		body = body[:cut]
+		email.Body = body
+		// The parts of the body are copies of it, so they are cut with it
+		setBodyParts(email)
+		size = layout.record(email)
+	}
+	if size > limit {
+		return fmt.Errorf("document of %d bytes exceeds the batch limit of %d bytes even without its body", size, maxBytes)
+	}
+	return nil
+}
+
+// splitBySize splits the emails into chunks whose payload with the layout is at most maxBytes.
+// Every email is expected to fit on its own, see fitDocument. A maxBytes of zero means no limit.
+func splitBySize(emails []*EmailJson, layout payloadLayout, maxBytes int) [][]*EmailJson {
+	if len(emails) == 0 {
+		return nil
+	}
+	if maxBytes <= 0 {
+		return [][]*EmailJson{emails}
+	}
+
+	var chunks [][]*EmailJson
+	start := 0
+	size := layout.overhead
+	for i, email := range emails {
+		recordSize := layout.record(email)
+		if i > start {
+			recordSize += layout.separator
+		}
+		if i > start && size+recordSize > maxBytes {
+			chunks = append(chunks, emails[start:i])
+			start = i
+			size = layout.overhead
+			recordSize -= layout.separator
+		}
+		size += recordSize
+	}
+	return append(chunks, emails[start:])
+}
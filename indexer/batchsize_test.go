@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// payloadSize returns the size of the bulk payload for the emails
+func payloadSize(emails []*EmailJson) int {
+	data, _ := json.Marshal(map[string]interface{}{"index": INDEX, "records": emails})
+	return len(data)
+}
+
+func TestSplitBySize(t *testing.T) {
+	var emails []*EmailJson
+	for i := 0; i < 10; i++ {
+		emails = append(emails, &EmailJson{Body: strings.Repeat("a", 100)})
+	}
+	maxBytes := payloadSize(emails[:3])
+
+	chunks := splitBySize(emails, zincLayout(INDEX), maxBytes)
+	if len(chunks) != 4 {
+		t.Fatalf("splitBySize did not return the expected number of chunks. Got: %d, expected: 4", len(chunks))
+	}
+	total := 0
+	for _, chunk := range chunks {
+		if size := payloadSize(chunk); size > maxBytes {
+			t.Errorf("splitBySize returned a chunk of %d bytes, over the limit of %d", size, maxBytes)
+		}
+		total += len(chunk)
+	}
+	if total != 10 {
+		t.Errorf("splitBySize lost emails. Got: %d, expected: 10", total)
+	}
+
+	// Without a limit the emails are kept together
+	if chunks := splitBySize(emails, zincLayout(INDEX), 0); len(chunks) != 1 || len(chunks[0]) != 10 {
+		t.Errorf("splitBySize split the emails without a limit")
+	}
+}
+
+func TestFitDocument(t *testing.T) {
+	maxBytes := payloadSize([]*EmailJson{{Body: strings.Repeat("é", 10)}})
+
+	// A document that fits is not changed
+	email := &EmailJson{Body: "short"}
+	if err := fitDocument(email, zincLayout(INDEX), maxBytes, OversizedTruncate); err != nil || email.Truncated {
+		t.Errorf("fitDocument changed a document that fits. Got: %v", err)
+	}
+
+	// An oversized document is truncated at a UTF-8 boundary
+	email = &EmailJson{Body: strings.Repeat("é\"", 1000)}
+	if err := fitDocument(email, zincLayout(INDEX), maxBytes, OversizedTruncate); err != nil {
+		t.Fatalf("fitDocument returned an error: %v", err)
+	}
+	if !email.Truncated || payloadSize([]*EmailJson{email}) > maxBytes {
+		t.Errorf("fitDocument did not truncate the document to %d bytes. Got: %d", maxBytes, payloadSize([]*EmailJson{email}))
+	}
+	if !strings.HasPrefix(strings.Repeat("é\"", 1000), email.Body) || !json.Valid([]byte(`"`+strings.ReplaceAll(email.Body, `"`, `\"`)+`"`)) {
+		t.Errorf("fitDocument did not cut the body at a character boundary. Got: %q", email.Body)
+	}
+
+	// Or rejected, depending on the policy
+	email = &EmailJson{Body: strings.Repeat("a", 1000)}
+	if err := fitDocument(email, zincLayout(INDEX), maxBytes, OversizedReject); err == nil {
+		t.Errorf("fitDocument did not reject an oversized document")
+	}
+}
+
+func TestSplitBySizeElasticsearch(t *testing.T) {
+	var emails []*EmailJson
+	for i := 0; i < 10; i++ {
+		emails = append(emails, &EmailJson{ID: fmt.Sprintf("id%d", i), Body: "a"})
+	}
+	sink := newElasticsearchSink("http://localhost:9200", INDEX, credentials{})
+	var payload bytes.Buffer
+	encodeBulkNDJSON(&payload, INDEX, emails[:6])
+	maxBytes := payload.Len()
+
+	// The NDJSON payload has an action line per document, so fewer documents fit than in a Zinc payload
+	chunks := splitBySize(emails, sinkLayout(sink, INDEX), maxBytes)
+	if len(chunks) != 2 {
+		t.Fatalf("splitBySize did not return the expected number of chunks. Got: %d, expected: 2", len(chunks))
+	}
+	for _, chunk := range chunks {
+		payload.Reset()
+		encodeBulkNDJSON(&payload, INDEX, chunk)
+		if payload.Len() > maxBytes {
+			t.Errorf("splitBySize returned a chunk of %d bytes, over the limit of %d", payload.Len(), maxBytes)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// bulkResponseItem is the result of a single record in a bulk response
+type bulkResponseItem struct {
+	ID     string      `json:"_id"`
+	Status int         `json:"status"`
+	Error  interface{} `json:"error,omitempty"`
+}
+
+// bulkResponse is the body returned by the bulk endpoints. Zinc reports the records it rejected in
+// items, in the same order they were sent; when items are missing only the record count is known.
+type bulkResponse struct {
+	Message     string                        `json:"message"`
+	RecordCount *int                          `json:"record_count"`
+	Error       string                        `json:"error"`
+	Items       []map[string]bulkResponseItem `json:"items"`
+}
+
+// recordError is a record of a batch that the server did not index
+type recordError struct {
+	// Index is the position of the record in the batch that was sent
+	Index int
+	Error string
+}
+
+// parseBulkResponse reads a bulk response for a batch of count records and returns the records that failed.
+// An empty body means every record was indexed.
+func parseBulkResponse(body io.Reader, count int) ([]recordError, error) {
+	var response bulkResponse
+	if err := json.NewDecoder(body).Decode(&response); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error decoding bulk response: %w", err)
+	}
+
+	// The failed items are matched to the records by position, so every record must have exactly one item
+	if len(response.Items) > 0 && len(response.Items) != count {
+		return nil, fmt.Errorf("server returned %d results for %d records", len(response.Items), count)
+	}
+	var failed []recordError
+	for i, item := range response.Items {
+		for _, result := range item {
+			if result.Error == nil && result.Status < 300 {
+				continue
+			}
+			failed = append(failed, recordError{Index: i, Error: describeBulkError(result)})
+		}
+	}
+	if len(failed) > 0 || len(response.Items) > 0 {
+		return failed, nil
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("bulk request failed: %s", response.Error)
+	}
+	if response.RecordCount != nil && *response.RecordCount != count {
+		return nil, fmt.Errorf("server indexed %d of %d records without reporting which failed", *response.RecordCount, count)
+	}
+	return nil, nil
+}
+
+// describeBulkError returns the error message of a failed bulk item
+func describeBulkError(item bulkResponseItem) string {
+	switch e := item.Error.(type) {
+	case nil:
+		return fmt.Sprintf("status %d", item.Status)
+	case string:
+		return e
+	case map[string]interface{}:
+		if reason, ok := e["reason"].(string); ok {
+			return reason
+		}
+	}
+	data, _ := json.Marshal(item.Error)
+	return string(data)
+}
+
+// runStats counts the outcome of the emails processed by a run
+type runStats struct {
+	// Indexed is the number of emails acknowledged by the server
+	Indexed int64
+	// Rejected is the number of emails the server refused, even after retrying
+	Rejected int64
+	// Skipped is the number of email files that could not be parsed and were not sent
+	Skipped int64
+}
+
+func (s *runStats) addIndexed(n int)  { atomic.AddInt64(&s.Indexed, int64(n)) }
+func (s *runStats) addRejected(n int) { atomic.AddInt64(&s.Rejected, int64(n)) }
+func (s *runStats) addSkipped(n int)  { atomic.AddInt64(&s.Skipped, int64(n)) }
+
+// String returns the summary logged at the end of a run
+func (s *runStats) String() string {
+	return fmt.Sprintf("%d indexed, %d rejected, %d skipped", atomic.LoadInt64(&s.Indexed), atomic.LoadInt64(&s.Rejected), atomic.LoadInt64(&s.Skipped))
+}
+
+// deadLetterSuffix is appended to the maildir path to build the default dead-letter file path
+const deadLetterSuffix = ".deadletter.ndjson"
+
+// deadLetter is a line of the dead-letter file
+type deadLetter struct {
+	SourcePath   string `json:"source_path"`
+	SourceOffset *int64 `json:"source_offset,omitempty"`
+	ID           string `json:"_id"`
+	Error        string `json:"error"`
+}
+
+// deadLetters writes the records rejected by the server to an NDJSON file, so they can be inspected
+// and sent again. The file is only created when the first record is rejected.
+type deadLetters struct {
+	path string
+
+	mu      sync.Mutex
+	file    io.WriteCloser
+	encoder *json.Encoder
+}
+
+// newDeadLetters returns a dead-letter writer for the file at path
+func newDeadLetters(path string) *deadLetters {
+	return &deadLetters{path: path}
+}
+
+// write appends a rejected record to the dead-letter file
+func (d *deadLetters) write(email *EmailJson, reason string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		file, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		d.file = file
+		d.encoder = json.NewEncoder(file)
+	}
+	return d.encoder.Encode(deadLetter{SourcePath: email.SourcePath, SourceOffset: email.SourceOffset, ID: email.ID, Error: reason})
+}
+
+// Close closes the dead-letter file, if it was created
+func (d *deadLetters) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
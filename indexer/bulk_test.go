@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseBulkResponse(t *testing.T) {
+	// Items with an error or a failed status are reported with their position
+	body := `{"items":[{"index":{"_id":"a","status":200}},{"index":{"_id":"b","status":400,"error":{"reason":"bad date"}}},{"index":{"_id":"c","status":500,"error":"disk full"}}]}`
+	failed, err := parseBulkResponse(strings.NewReader(body), 3)
+	if err != nil {
+		t.Fatalf("parseBulkResponse returned an error: %v", err)
+	}
+	expected := []recordError{{Index: 1, Error: "bad date"}, {Index: 2, Error: "disk full"}}
+	if fmt.Sprint(failed) != fmt.Sprint(expected) {
+		t.Errorf("parseBulkResponse did not return the failed records. Got: %v, expected: %v", failed, expected)
+	}
+
+	// Items that do not match the records one to one cannot be attributed
+	if _, err := parseBulkResponse(strings.NewReader(`{"items":[{"index":{"status":200}},{"index":{"status":400}}]}`), 1); err == nil {
+		t.Errorf("parseBulkResponse did not return an error for more items than records")
+	}
+
+	// A summary without items is accepted if every record was counted
+	failed, err = parseBulkResponse(strings.NewReader(`{"message":"v2 data inserted","record_count":3}`), 3)
+	if err != nil || len(failed) != 0 {
+		t.Errorf("parseBulkResponse did not accept a complete summary. Got: %v, %v", failed, err)
+	}
+	if _, err := parseBulkResponse(strings.NewReader(`{"message":"v2 data inserted","record_count":2}`), 3); err == nil {
+		t.Errorf("parseBulkResponse did not return an error for missing records")
+	}
+
+	// An empty body means success
+	if failed, err := parseBulkResponse(strings.NewReader(""), 3); err != nil || len(failed) != 0 {
+		t.Errorf("parseBulkResponse did not accept an empty body. Got: %v, %v", failed, err)
+	}
+}
+
+// rejectingServer returns a bulk server that rejects the records of the given files, at most times times each
+func rejectingServer(reject map[string]int) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Records []*EmailJson `json:"records"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		mu.Lock()
+		defer mu.Unlock()
+		items := make([]map[string]bulkResponseItem, len(payload.Records))
+		for i, record := range payload.Records {
+			item := bulkResponseItem{ID: record.ID, Status: 200}
+			if reject[filepath.Base(record.SourcePath)] > 0 {
+				reject[filepath.Base(record.SourcePath)]--
+				item = bulkResponseItem{ID: record.ID, Status: 400, Error: "mapper_parsing_exception"}
+			}
+			items[i] = map[string]bulkResponseItem{"index": item}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	}))
+}
+
+func TestPipelineRunRejectedRecords(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	writeTestEmails(t, tempDir, 4)
+	ioutil.WriteFile(filepath.Join(tempDir, "malformed.txt"), []byte("From test@example.com\n\nbody"), 0644)
+
+	// email1 is accepted when it is sent again, email2 is always rejected
+	ts := rejectingServer(map[string]int{"email1.txt": 1, "email2.txt": 10})
+	defer ts.Close()
+
+	deadLetterPath := filepath.Join(tempDir, "dead.ndjson")
+	deadLetters := newDeadLetters(deadLetterPath)
+	p := &pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), source: maildirSource(tempDir, FormatMaildir, 10, nil), deadLetters: deadLetters, opts: Options{RecordRetries: 2}}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatalf("pipeline.run returned an error: %v", err)
+	}
+	deadLetters.Close()
+
+	if p.stats.Indexed != 3 || p.stats.Rejected != 1 || p.stats.Skipped != 1 {
+		t.Errorf("pipeline.run did not count the emails correctly. Got: %s", &p.stats)
+	}
+
+	file, err := os.Open(deadLetterPath)
+	if err != nil {
+		t.Fatalf("the dead-letter file was not written: %v", err)
+	}
+	defer file.Close()
+	var lines []deadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line deadLetter
+		json.Unmarshal(scanner.Bytes(), &line)
+		lines = append(lines, line)
+	}
+	if len(lines) != 1 || filepath.Base(lines[0].SourcePath) != "email2.txt" || lines[0].Error != "mapper_parsing_exception" {
+		t.Errorf("the dead-letter file does not hold the rejected email. Got: %+v", lines)
+	}
+}
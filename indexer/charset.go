@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// wordDecoder decodes RFC 2047 encoded words in any charset known to the WHATWG encoding index
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// charsetReader returns a reader that transcodes input from the charset to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %s: %w", charset, err)
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
+
+// toUTF8 transcodes data from the declared charset to UTF-8. When the charset is missing, claims ASCII
+// or is unknown, data is kept if it is valid UTF-8 and otherwise read as windows-1252, the usual
+// encoding of undeclared 8-bit mail. Invalid bytes are replaced instead of returning an error.
+func toUTF8(charset string, data []byte) string {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset != "" && charset != "us-ascii" && charset != "ascii" {
+		if encoding, err := htmlindex.Get(charset); err == nil {
+			if decoded, err := encoding.NewDecoder().Bytes(data); err == nil {
+				return string(decoded)
+			}
+		}
+	}
+
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "�")
+	}
+	return string(decoded)
+}
+
+// decodeHeaderValue decodes the RFC 2047 encoded words of a header value. Values that cannot be
+// decoded, or that hold raw 8-bit text, go through the same fallback as undeclared bodies.
+func decodeHeaderValue(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		decoded = value
+	}
+	return toUTF8("", []byte(decoded))
+}
+
+// decodeHeaders returns a copy of the header with every value decoded to UTF-8
+func decodeHeaders(header map[string][]string) map[string][]string {
+	decoded := make(map[string][]string, len(header))
+	for key, values := range header {
+		decodedValues := make([]string, len(values))
+		for i, value := range values {
+			decodedValues[i] = decodeHeaderValue(value)
+		}
+		decoded[key] = decodedValues
+	}
+	return decoded
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDecodeHeaderValue(t *testing.T) {
+	tests := map[string]string{
+		"=?iso-8859-1?Q?Jos=E9_Garc=EDa?=":      "José García",
+		"=?utf-8?B?Sm9zw6kgR2FyY8OtYQ==?=":      "José García",
+		"Re: =?windows-1252?Q?caf=E9?= meeting": "Re: café meeting",
+		"plain subject":                         "plain subject",
+		"=?unknown-charset?Q?abc?=":             "=?unknown-charset?Q?abc?=",
+		"raw latin1 \xe9":                       "raw latin1 é",
+	}
+	for value, expected := range tests {
+		if got := decodeHeaderValue(value); got != expected {
+			t.Errorf("decodeHeaderValue(%q) = %q, expected: %q", value, got, expected)
+		}
+	}
+}
+
+func TestToUTF8(t *testing.T) {
+	if got := toUTF8("iso-8859-1", []byte("caf\xe9")); got != "café" {
+		t.Errorf("toUTF8 did not transcode iso-8859-1. Got: %q", got)
+	}
+	if got := toUTF8("windows-1252", []byte("\x93quoted\x94")); got != "“quoted”" {
+		t.Errorf("toUTF8 did not transcode windows-1252. Got: %q", got)
+	}
+	// Undeclared bodies are kept when they are valid UTF-8 and read as windows-1252 otherwise
+	if got := toUTF8("", []byte("café")); got != "café" {
+		t.Errorf("toUTF8 changed a valid UTF-8 body. Got: %q", got)
+	}
+	if got := toUTF8("us-ascii", []byte("caf\xe9")); got != "café" {
+		t.Errorf("toUTF8 did not detect an 8-bit body declared as ASCII. Got: %q", got)
+	}
+	// Invalid bytes in a declared UTF-8 body are replaced
+	if got := toUTF8("utf-8", []byte("bad \xff byte")); got != "bad � byte" {
+		t.Errorf("toUTF8 did not replace invalid bytes. Got: %q", got)
+	}
+}
+
+func TestParseEmailCharset(t *testing.T) {
+	tempFile, _ := ioutil.TempFile("", "email")
+	defer os.Remove(tempFile.Name())
+	content := "From: test@example.com\nSubject: =?iso-8859-1?Q?Se=F1or?=\nContent-Type: text/plain; charset=iso-8859-1\n\nMa\xf1ana"
+	ioutil.WriteFile(tempFile.Name(), []byte(content), 0644)
+
+	email, err := parseEmail(tempFile.Name())
+	if err != nil {
+		t.Fatalf("parseEmail returned an error: %v", err)
+	}
+	if email.Header["Subject"][0] != "Señor" {
+		t.Errorf("parseEmail did not decode the subject. Got: %q, expected: Señor", email.Header["Subject"][0])
+	}
+	if email.Body != "Mañana" {
+		t.Errorf("parseEmail did not transcode the body. Got: %q, expected: Mañana", email.Body)
+	}
+}
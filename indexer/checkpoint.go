@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// checkpointSuffix is appended to the maildir path to build the default checkpoint path
+const checkpointSuffix = ".checkpoint.json"
+
+// batchRecord identifies a batch that was acknowledged by the server. The first and last paths
+// are kept so a resumed run can tell whether the batch with the same sequence number still
+// holds the same files.
+type batchRecord struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Count int    `json:"count"`
+}
+
+// Checkpoint records which batches of a maildir have been acknowledged by the server,
+// so an interrupted run can be resumed without sending them again
+type Checkpoint struct {
+	Maildir   string              `json:"maildir"`
+	BatchSize int                 `json:"batch_size"`
+	Batches   map[int]batchRecord `json:"batches"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// defaultCheckpointPath returns the checkpoint path used for a maildir when none is given
+func defaultCheckpointPath(maildir string) string {
+	return filepath.Clean(maildir) + checkpointSuffix
+}
+
+// newCheckpoint returns an empty checkpoint for the maildir that will be saved to path
+func newCheckpoint(path, maildir string, batchSize int) *Checkpoint {
+	return &Checkpoint{
+		Maildir:   filepath.Clean(maildir),
+		BatchSize: batchSize,
+		Batches:   map[int]batchRecord{},
+		path:      path,
+	}
+}
+
+// loadCheckpoint reads the checkpoint at path. If the file does not exist an empty checkpoint is returned.
+// It returns an error if the checkpoint was written for a different maildir or batch size, because the
+// batch sequence numbers would not refer to the same files.
+func loadCheckpoint(path, maildir string, batchSize int) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No checkpoint found at %s, starting from the beginning", path)
+		return newCheckpoint(path, maildir, batchSize), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := newCheckpoint(path, maildir, batchSize)
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("error reading checkpoint %s: %w", path, err)
+	}
+	if checkpoint.Maildir != filepath.Clean(maildir) || checkpoint.BatchSize != batchSize {
+		return nil, fmt.Errorf("checkpoint %s was created for maildir %s with batch size %d", path, checkpoint.Maildir, checkpoint.BatchSize)
+	}
+	if checkpoint.Batches == nil {
+		checkpoint.Batches = map[int]batchRecord{}
+	}
+	log.Printf("Resuming from checkpoint %s with %d acknowledged batches", path, len(checkpoint.Batches))
+	return checkpoint, nil
+}
+
+// recordFor returns the record that identifies the given batch
+func recordFor(b batch) batchRecord {
+	if len(b.paths) == 0 {
+		return batchRecord{}
+	}
+	return batchRecord{First: b.name(0), Last: b.name(len(b.paths) - 1), Count: len(b.paths)}
+}
+
+// acknowledged reports whether the batch was already acknowledged by the server in a previous run
+func (c *Checkpoint) acknowledged(b batch) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record, ok := c.Batches[b.seq]
+	return ok && record == recordFor(b)
+}
+
+// acknowledge records the batch as acknowledged by the server and saves the checkpoint
+func (c *Checkpoint) acknowledge(b batch) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Batches[b.seq] = recordFor(b)
+	return c.save()
+}
+
+// save writes the checkpoint atomically
+func (c *Checkpoint) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, data)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as path, syncs it and
+// renames it over path, so a crash never leaves a partially written file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCheckpointSaveAndLoad(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "checkpoint")
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "maildir"+checkpointSuffix)
+
+	b := batch{seq: 3, paths: []string{"a", "b", "c"}}
+	checkpoint := newCheckpoint(path, "maildir", 3)
+	if err := checkpoint.acknowledge(b); err != nil {
+		t.Fatalf("acknowledge returned an error: %v", err)
+	}
+
+	loaded, err := loadCheckpoint(path, "maildir", 3)
+	if err != nil {
+		t.Fatalf("loadCheckpoint returned an error: %v", err)
+	}
+	if !loaded.acknowledged(b) {
+		t.Errorf("loadCheckpoint did not restore the acknowledged batch")
+	}
+	if loaded.acknowledged(batch{seq: 3, paths: []string{"a", "b", "d"}}) {
+		t.Errorf("acknowledged returned true for a batch holding different files")
+	}
+
+	// No temporary files should be left next to the checkpoint
+	files, _ := ioutil.ReadDir(tempDir)
+	if len(files) != 1 {
+		t.Errorf("save left temporary files behind. Got: %d files, expected: 1", len(files))
+	}
+}
+
+func TestLoadCheckpointMissingFile(t *testing.T) {
+	checkpoint, err := loadCheckpoint("/invalid/directory/checkpoint.json", "maildir", 10)
+	if err != nil {
+		t.Fatalf("loadCheckpoint returned an error for a missing file: %v", err)
+	}
+	if len(checkpoint.Batches) != 0 {
+		t.Errorf("loadCheckpoint returned acknowledged batches for a missing file")
+	}
+}
+
+func TestLoadCheckpointMismatch(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "checkpoint")
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "checkpoint.json")
+	newCheckpoint(path, "maildir", 10).save()
+
+	if _, err := loadCheckpoint(path, "maildir", 20); err == nil {
+		t.Errorf("loadCheckpoint did not return an error for a different batch size")
+	}
+	if _, err := loadCheckpoint(path, "other", 10); err == nil {
+		t.Errorf("loadCheckpoint did not return an error for a different maildir")
+	}
+}
+
+func TestPipelineRunResume(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	writeTestEmails(t, tempDir, 6)
+	path := filepath.Join(tempDir, "checkpoint.json")
+
+	// Fail the second request, so only one of the three batches is acknowledged
+	var mu sync.Mutex
+	requests := 0
+	received := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Records []*EmailJson `json:"records"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received += len(payload.Records)
+	}))
+	defer ts.Close()
+
+	opts := Options{Parsers: 1, Uploaders: 1}
+	checkpoint := newCheckpoint(path, tempDir, 2)
+	batches := [][]string{
+		{tempDir + "/email0.txt", tempDir + "/email1.txt"},
+		{tempDir + "/email2.txt", tempDir + "/email3.txt"},
+		{tempDir + "/email4.txt", tempDir + "/email5.txt"},
+	}
+	if err := (&pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), source: sliceSource(batches), totalBatches: 3, checkpoint: checkpoint, opts: opts}).run(context.Background()); err == nil {
+		t.Fatal("pipeline.run did not return an error when the server rejected a batch")
+	}
+
+	// The resumed run must only send the batches that were not acknowledged
+	received = 0
+	checkpoint, err := loadCheckpoint(path, tempDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), source: sliceSource(batches), totalBatches: 3, checkpoint: checkpoint, opts: opts}).run(context.Background()); err != nil {
+		t.Errorf("pipeline.run returned an error on resume: %v", err)
+	}
+	if received != 4 {
+		t.Errorf("pipeline.run did not skip the acknowledged batch. Got: %d emails, expected: 4", received)
+	}
+}
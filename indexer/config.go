@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// envPrefix is the prefix of the environment variables that set the flags, e.g. ZINC_BATCH_SIZE sets -batch-size
+	envPrefix = "ZINC_"
+	// configFlag is the flag that gives the path of the config file, also read from ZINC_CONFIG
+	configFlag = "config"
+)
+
+// credentials are the basic auth credentials sent to the server
+type credentials struct {
+	Username string
+	Password string
+}
+
+// setAuth adds the credentials to the request, unless there is no username
+func (c credentials) setAuth(req *http.Request) {
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// credentials returns the credentials given by the options, reading the password from PasswordFile if it is set
+func (o Options) credentials() (credentials, error) {
+	auth := credentials{Username: o.Username, Password: o.Password}
+	if o.PasswordFile != "" {
+		data, err := ioutil.ReadFile(o.PasswordFile)
+		if err != nil {
+			return auth, fmt.Errorf("error reading password file: %w", err)
+		}
+		auth.Password = strings.TrimRight(string(data), "\r\n")
+	}
+	return auth, nil
+}
+
+// envName returns the environment variable that sets the flag with the given name
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfigFile reads a YAML config file whose keys are flag names, e.g. "batch-size: 500".
+// Underscores can be used instead of dashes in the keys.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("config file %s: %s must be a single value", path, key)
+		case nil:
+			value = ""
+		}
+		values[strings.ReplaceAll(key, "_", "-")] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+// applyConfig sets the flags that were not given on the command line from the ZINC_* environment
+// variables and then from the config file, so flags take precedence over the environment and the
+// environment over the config file. lookupEnv is usually os.LookupEnv.
+func applyConfig(flags *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	configPath, _ := lookupEnv(envName(configFlag))
+	if given[configFlag] {
+		configPath = flags.Lookup(configFlag).Value.String()
+	}
+	var file map[string]string
+	if configPath != "" {
+		var err error
+		file, err = loadConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+		for key := range file {
+			if key == configFlag || flags.Lookup(key) == nil {
+				return fmt.Errorf("config file %s: unknown option %s", configPath, key)
+			}
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || f.Name == configFlag {
+			return
+		}
+		source := envName(f.Name)
+		value, ok := lookupEnv(source)
+		if !ok {
+			source = configPath
+			value, ok = file[f.Name]
+		}
+		if !ok {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s in %s: %w", value, f.Name, source, setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testFlags returns a flag set with a few of the indexer flags, parsed from args
+func testFlags(t *testing.T, opts *Options, args ...string) *flag.FlagSet {
+	flags := flag.NewFlagSet("indexer", flag.ContinueOnError)
+	flags.String(configFlag, "", "")
+	flags.StringVar(&opts.Index, "index", opts.Index, "")
+	flags.StringVar(&opts.Username, "user", opts.Username, "")
+	flags.IntVar(&opts.BatchSize, "batch-size", opts.BatchSize, "")
+	flags.BoolVar(&opts.Gzip, "gzip", opts.Gzip, "")
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("flags.Parse returned an error: %v", err)
+	}
+	return flags
+}
+
+// envLookup returns a lookup function for the given environment
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(tempDir)
+	configPath := filepath.Join(tempDir, "indexer.yaml")
+	ioutil.WriteFile(configPath, []byte("index: from_file\nuser: file_user\nbatch_size: 500\ngzip: true\n"), 0644)
+
+	// The flag wins over the environment, which wins over the config file
+	opts := DefaultOptions()
+	flags := testFlags(t, &opts, "-config", configPath, "-index", "from_flag")
+	env := map[string]string{"ZINC_INDEX": "from_env", "ZINC_USER": "env_user"}
+	if err := applyConfig(flags, envLookup(env)); err != nil {
+		t.Fatalf("applyConfig returned an error: %v", err)
+	}
+	if opts.Index != "from_flag" || opts.Username != "env_user" || opts.BatchSize != 500 || !opts.Gzip {
+		t.Errorf("applyConfig did not apply the configuration in order. Got: index %s, user %s, batch size %d, gzip %v", opts.Index, opts.Username, opts.BatchSize, opts.Gzip)
+	}
+
+	// The config file can also be given by the environment
+	opts = DefaultOptions()
+	flags = testFlags(t, &opts)
+	if err := applyConfig(flags, envLookup(map[string]string{"ZINC_CONFIG": configPath})); err != nil {
+		t.Fatalf("applyConfig returned an error: %v", err)
+	}
+	if opts.Index != "from_file" {
+		t.Errorf("applyConfig did not read the config file from ZINC_CONFIG. Got: %s", opts.Index)
+	}
+
+	// Without any configuration the defaults are kept
+	opts = DefaultOptions()
+	flags = testFlags(t, &opts)
+	if err := applyConfig(flags, envLookup(nil)); err != nil || opts.Index != INDEX || opts.BatchSize != BATCH_SIZE {
+		t.Errorf("applyConfig did not keep the defaults. Got: %s, %d, %v", opts.Index, opts.BatchSize, err)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(tempDir)
+	configPath := filepath.Join(tempDir, "indexer.yaml")
+
+	opts := DefaultOptions()
+	ioutil.WriteFile(configPath, []byte("indx: email\n"), 0644)
+	if err := applyConfig(testFlags(t, &opts, "-config", configPath), envLookup(nil)); err == nil {
+		t.Errorf("applyConfig did not return an error for an unknown option")
+	}
+	ioutil.WriteFile(configPath, []byte("index: [a, b]\n"), 0644)
+	if err := applyConfig(testFlags(t, &opts, "-config", configPath), envLookup(nil)); err == nil {
+		t.Errorf("applyConfig did not return an error for a list value")
+	}
+	if err := applyConfig(testFlags(t, &opts), envLookup(map[string]string{"ZINC_BATCH_SIZE": "many"})); err == nil {
+		t.Errorf("applyConfig did not return an error for an invalid environment value")
+	}
+	if err := applyConfig(testFlags(t, &opts, "-config", filepath.Join(tempDir, "missing.yaml")), envLookup(nil)); err == nil {
+		t.Errorf("applyConfig did not return an error for a missing config file")
+	}
+}
+
+func TestOptionsCredentials(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(tempDir)
+	passwordFile := filepath.Join(tempDir, "password")
+	ioutil.WriteFile(passwordFile, []byte("s3cret\n"), 0600)
+
+	// The password file takes precedence over the password and its trailing newline is removed
+	opts := Options{Username: "admin", Password: "other", PasswordFile: passwordFile}
+	auth, err := opts.credentials()
+	if err != nil {
+		t.Fatalf("credentials returned an error: %v", err)
+	}
+	if auth.Username != "admin" || auth.Password != "s3cret" {
+		t.Errorf("credentials did not read the password file. Got: %+v", auth)
+	}
+
+	opts.PasswordFile = filepath.Join(tempDir, "missing")
+	if _, err := opts.credentials(); err == nil {
+		t.Errorf("credentials did not return an error for a missing password file")
+	}
+}
+
+func TestCredentialsSetAuth(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	credentials{Username: "admin", Password: "s3cret"}.setAuth(req)
+	if user, password, ok := req.BasicAuth(); !ok || user != "admin" || password != "s3cret" {
+		t.Errorf("setAuth did not set the basic auth. Got: %s, %s", user, password)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost", nil)
+	credentials{}.setAuth(req)
+	if _, _, ok := req.BasicAuth(); ok {
+		t.Errorf("setAuth set basic auth without a username")
+	}
+}
+
+func TestNewSinkZincPassword(t *testing.T) {
+	opts := DefaultOptions()
+	if _, err := newSink(opts); err == nil {
+		t.Errorf("newSink did not return an error for a Zinc sink without password")
+	}
+	opts.Password = "s3cret"
+	sink, err := newSink(opts)
+	if err != nil {
+		t.Fatalf("newSink returned an error: %v", err)
+	}
+	if zinc := sink.(*zincSink); zinc.auth.Password != "s3cret" || zinc.index != INDEX {
+		t.Errorf("newSink did not configure the Zinc sink. Got: %+v", zinc)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// bracketedName matches a name followed by an address in angle brackets, as in
+// "Allen, Phillip K. </O=ENRON/OU=NA/CN=RECIPIENTS/CN=PALLEN>" or "Tim Belden <Tim Belden/Enron@EnronXGate>"
+var bracketedName = regexp.MustCompile(`([^<>]*)<[^<>]*>`)
+
+// firstName matches a first name followed by initials, as in "Tim" or "Phillip K.", which follows the last name
+// in a "Last, First" name
+var firstName = regexp.MustCompile(`^[A-Za-z][A-Za-z'-]*( [A-Za-z]\.?)*$`)
+
+// notesFolders is the folder Lotus Notes exports keep their folders in
+const notesFolders = "notes folders"
+
+// normalizeName trims the quotes and spaces around a name, collapses its spaces and turns "Last, First" into
+// "First Last", so the same person is written the same way in every email
+func normalizeName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	name = strings.Trim(name, `"' `)
+	if last, first, found := strings.Cut(name, ", "); found && !strings.Contains(first, ",") && !strings.Contains(name, "@") {
+		name = first + " " + last
+	}
+	return strings.Trim(name, `"' `)
+}
+
+// parseXNames returns the names of an X-From, X-To, X-cc or X-bcc header. When the names are followed by
+// addresses in angle brackets, the names may hold commas, so only the brackets split them; otherwise the
+// list is split on commas, unless single is set because the header names one person, and the pieces of
+// "Last, First" names are joined again.
+func parseXNames(value string, single bool) []string {
+	var parts []string
+	switch {
+	case strings.Contains(value, "<"):
+		for _, match := range bracketedName.FindAllStringSubmatch(value, -1) {
+			parts = append(parts, strings.TrimLeft(match[1], ", "))
+		}
+	case single:
+		parts = []string{value}
+	default:
+		parts = joinLastFirst(strings.Split(value, ","))
+	}
+
+	var names []string
+	for _, part := range parts {
+		if name := normalizeName(part); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// joinLastFirst joins the pieces of a list split on commas that are the last and first name of one person, as
+// in "Allen, Phillip K., Belden, Tim", where a piece is taken as a first name if it is a word with initials
+func joinLastFirst(pieces []string) []string {
+	parts := make([]string, 0, len(pieces))
+	for i := 0; i < len(pieces); i++ {
+		last := strings.TrimSpace(pieces[i])
+		if i+1 < len(pieces) && last != "" && !strings.Contains(last, "@") {
+			if first := strings.Join(strings.Fields(pieces[i+1]), " "); firstName.MatchString(first) {
+				parts = append(parts, last+", "+first)
+				i++
+				continue
+			}
+		}
+		parts = append(parts, pieces[i])
+	}
+	return parts
+}
+
+// normalizeXFolder returns the folder of an X-Folder header below the mailbox, lowercased and separated with
+// slashes. The first component names the export, and the owner's name or the Notes container that may follow
+// it is dropped too, so "\Phillip_Allen_Jan2002_1\Allen, Phillip K.\'Sent Mail" gives "sent mail" and
+// "\Phillip_Allen_June2001\Notes Folders\All documents" gives "all documents".
+func normalizeXFolder(value string) string {
+	var parts []string
+	for _, part := range strings.Split(value, `\`) {
+		// Outlook exports prefix some folder names with a quote
+		if part = strings.Trim(strings.Join(strings.Fields(part), " "), "'"); part != "" {
+			parts = append(parts, strings.ToLower(part))
+		}
+	}
+	if len(parts) > 1 {
+		parts = parts[1:]
+		if len(parts) > 1 && (parts[0] == notesFolders || strings.Contains(parts[0], ", ")) {
+			parts = parts[1:]
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// setEnronFields fills the fields parsed from the X- headers the Enron corpus adds to every email, with the
+// names of the sender and recipients and the folder and mailbox the email was exported from
+func setEnronFields(email *EmailJson, header mail.Header) {
+	email.XFromNames = parseXNames(decodeHeaderValue(header.Get("X-From")), true)
+	email.XToNames = parseXNames(decodeHeaderValue(header.Get("X-To")), false)
+	email.XCcNames = parseXNames(decodeHeaderValue(header.Get("X-Cc")), false)
+	email.XBccNames = parseXNames(decodeHeaderValue(header.Get("X-Bcc")), false)
+	email.Folder = normalizeXFolder(decodeHeaderValue(header.Get("X-Folder")))
+	email.OriginMailbox = strings.ToLower(strings.TrimSpace(header.Get("X-Origin")))
+}
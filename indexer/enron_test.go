@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseXNames(t *testing.T) {
+	tests := []struct {
+		value    string
+		single   bool
+		expected []string
+	}{
+		{"Phillip K Allen", true, []string{"Phillip K Allen"}},
+		{"Allen, Phillip K.", true, []string{"Phillip K. Allen"}},
+		{"Allen, Phillip K. </O=ENRON/OU=NA/CN=RECIPIENTS/CN=PALLEN>", true, []string{"Phillip K. Allen"}},
+		{"Grigsby, Mike </O=ENRON/OU=NA/CN=RECIPIENTS/CN=Mgrigsb>, Holst, Keith </O=ENRON/OU=NA/CN=RECIPIENTS/CN=Kholst>", false, []string{"Mike Grigsby", "Keith Holst"}},
+		{"Tim Belden <Tim Belden/Enron@EnronXGate>, \"Mike  Swerzbin\" <Mike Swerzbin/HOU/ECT@ECT>", false, []string{"Tim Belden", "Mike Swerzbin"}},
+		{"pallen70@hotmail.com, 'jsmith@austintx.com'", false, []string{"pallen70@hotmail.com", "jsmith@austintx.com"}},
+		{"Allen, Phillip K., Belden, Tim", false, []string{"Phillip K. Allen", "Tim Belden"}},
+		{"Van Hooser, Steve, Phillip K Allen, Mike Swerzbin", false, []string{"Steve Van Hooser", "Phillip K Allen", "Mike Swerzbin"}},
+		{"", false, nil},
+	}
+	for _, test := range tests {
+		if got := parseXNames(test.value, test.single); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("parseXNames(%q) = %q, expected: %q", test.value, got, test.expected)
+		}
+	}
+}
+
+func TestNormalizeXFolder(t *testing.T) {
+	tests := map[string]string{
+		`\Phillip_Allen_Jan2002_1\Allen, Phillip K.\'Sent Mail`:   "sent mail",
+		`\Phillip_Allen_June2001\Notes Folders\All documents`:     "all documents",
+		`\Phillip_Allen_Dec2000\Notes Folders\Discussion threads`: "discussion threads",
+		`\ExMerge - Arnold, John\Inbox\Projects`:                  "inbox/projects",
+		`\Kate_Symes_Jun2001\Notes Folders\Notes inbox`:           "notes inbox",
+		`Inbox`: "inbox",
+		``:      "",
+	}
+	for value, expected := range tests {
+		if got := normalizeXFolder(value); got != expected {
+			t.Errorf("normalizeXFolder(%q) = %q, expected: %q", value, got, expected)
+		}
+	}
+}
+
+func TestSetEnronFields(t *testing.T) {
+	raw := []byte("Message-ID: <18782981.1075855378110.JavaMail.evans@thyme>\n" +
+		"From: phillip.allen@enron.com\n" +
+		"Subject: Re: test\n" +
+		"X-From: Phillip K Allen\n" +
+		"X-To: Tim Belden <Tim Belden/Enron@EnronXGate>\n" +
+		"X-cc: Grigsby, Mike </O=ENRON/OU=NA/CN=RECIPIENTS/CN=Mgrigsb>\n" +
+		"X-bcc: \n" +
+		"X-Folder: \\Phillip_Allen_Jan2002_1\\Allen, Phillip K.\\'Sent Mail\n" +
+		"X-Origin: Allen-P\n" +
+		"X-FileName: pallen (Non-Privileged).pst\n" +
+		"\n" +
+		"body")
+	email, err := parseMessage(raw, "1.", nil, false)
+	if err != nil {
+		t.Fatalf("parseMessage returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(email.XFromNames, []string{"Phillip K Allen"}) || !reflect.DeepEqual(email.XToNames, []string{"Tim Belden"}) {
+		t.Errorf("the X-From and X-To names were not parsed. Got: %q, %q", email.XFromNames, email.XToNames)
+	}
+	if !reflect.DeepEqual(email.XCcNames, []string{"Mike Grigsby"}) || email.XBccNames != nil {
+		t.Errorf("the X-cc and X-bcc names were not parsed. Got: %q, %q", email.XCcNames, email.XBccNames)
+	}
+	if email.Folder != "sent mail" || email.OriginMailbox != "allen-p" {
+		t.Errorf("the folder and origin mailbox were not parsed. Got: %q, %q", email.Folder, email.OriginMailbox)
+	}
+}
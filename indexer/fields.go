@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Address is a parsed email address
+type Address struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+	Domain  string `json:"domain,omitempty"`
+}
+
+// addressParser decodes RFC 2047 encoded display names while parsing addresses
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// newAddress returns an Address with its domain taken from the part after the last @
+func newAddress(name, address string) Address {
+	domain := ""
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		domain = strings.ToLower(address[at+1:])
+	}
+	return Address{Name: toUTF8("", []byte(name)), Address: address, Domain: domain}
+}
+
+// parseAddressList parses every value of an address header. Lists that are not valid RFC 5322 are
+// split on commas and each address is parsed on its own; the ones that still fail are kept as written.
+func parseAddressList(values []string) []Address {
+	var addresses []Address
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		if list, err := addressParser.ParseList(value); err == nil {
+			for _, address := range list {
+				addresses = append(addresses, newAddress(address.Name, address.Address))
+			}
+			continue
+		}
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			if address, err := addressParser.Parse(part); err == nil {
+				addresses = append(addresses, newAddress(address.Name, address.Address))
+			} else {
+				addresses = append(addresses, newAddress("", part))
+			}
+		}
+	}
+	return addresses
+}
+
+// parseDate parses the Date header and returns it in UTC
+func parseDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	date, err := mail.ParseDate(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date.UTC(), true
+}
+
+// setStructuredFields fills the typed fields of the email from its raw headers, so Zinc can sort and
+// filter on the date and aggregate on addresses without looking inside the header map
+func setStructuredFields(email *EmailJson, header mail.Header) {
+	if date, ok := parseDate(header.Get("Date")); ok {
+		email.Date = date.Format(time.RFC3339)
+		email.Timestamp = email.Date
+	}
+	email.From = parseAddressList(header["From"])
+	email.To = parseAddressList(header["To"])
+	email.Cc = parseAddressList(header["Cc"])
+	email.Bcc = parseAddressList(header["Bcc"])
+	email.Subject = decodeHeaderValue(header.Get("Subject"))
+	email.MessageID = strings.TrimSpace(header.Get("Message-ID"))
+	setEnronFields(email, header)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestSetStructuredFields(t *testing.T) {
+	header := mail.Header{
+		"Date":       {"Mon, 14 May 2001 16:39:00 -0700 (PDT)"},
+		"From":       {"=?iso-8859-1?Q?Jos=E9?= <Jose@Enron.com>"},
+		"To":         {"john.doe@enron.com, Jane <jane@example.com>"},
+		"Cc":         {"'odd'@enron.com, bob@enron.com"},
+		"Subject":    {"=?utf-8?Q?Caf=C3=A9?="},
+		"Message-Id": {"<18782981.1075855378110.JavaMail.evans@thyme>"},
+	}
+	email := &EmailJson{}
+	setStructuredFields(email, header)
+
+	if email.Date != "2001-05-14T23:39:00Z" || email.Timestamp != email.Date {
+		t.Errorf("setStructuredFields did not normalize the date to UTC. Got: %s, %s", email.Date, email.Timestamp)
+	}
+	expectedFrom := Address{Name: "José", Address: "Jose@Enron.com", Domain: "enron.com"}
+	if len(email.From) != 1 || email.From[0] != expectedFrom {
+		t.Errorf("setStructuredFields did not parse the sender. Got: %+v, expected: %+v", email.From, expectedFrom)
+	}
+	if len(email.To) != 2 || email.To[1].Name != "Jane" || email.To[1].Domain != "example.com" {
+		t.Errorf("setStructuredFields did not parse the recipients. Got: %+v", email.To)
+	}
+	// An invalid address does not drop the valid ones of the same list
+	if len(email.Cc) != 2 || email.Cc[1].Address != "bob@enron.com" {
+		t.Errorf("setStructuredFields did not salvage the cc list. Got: %+v", email.Cc)
+	}
+	if email.Subject != "Café" {
+		t.Errorf("setStructuredFields did not decode the subject. Got: %s", email.Subject)
+	}
+	if email.MessageID != "<18782981.1075855378110.JavaMail.evans@thyme>" {
+		t.Errorf("setStructuredFields did not set the message id. Got: %s", email.MessageID)
+	}
+}
+
+func TestSetStructuredFieldsInvalidDate(t *testing.T) {
+	email := &EmailJson{}
+	setStructuredFields(email, mail.Header{"Date": {"not a date"}})
+	if email.Date != "" || email.Timestamp != "" {
+		t.Errorf("setStructuredFields set a date for an invalid Date header. Got: %s", email.Date)
+	}
+	if email.From != nil {
+		t.Errorf("setStructuredFields returned senders for a missing From header")
+	}
+}
@@ -1,3 +1,13 @@
 module challenge-zinc/indexer
 
 go 1.18
+
+require (
+	github.com/fsnotify/fsnotify v1.6.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sync v0.5.0
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// errMalformedHeaders is returned for an email whose headers cannot be parsed when it is not salvaged
+var errMalformedHeaders = errors.New("malformed headers")
+
+// validFieldName reports whether name can be the name of a header field: printable ASCII without spaces or colons
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// salvageHeaders parses the header block of an email that mail.ReadMessage refused, line by line. The valid fields
+// are kept in the header, the lines that are not fields are returned as raw headers, and a warning describes every
+// line that was not kept. The header block ends at the first blank line; what follows is the body.
+func salvageHeaders(raw []byte) (header mail.Header, body []byte, rawHeaders []string, warnings []string) {
+	header = mail.Header{}
+	block := raw
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		block, body = raw[:i+1], raw[i+2:]
+	}
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 && i+2 <= len(block) {
+		block, body = raw[:i+2], raw[i+4:]
+	}
+
+	// lastKey is the field the previous line belongs to, or empty if that line was a raw header
+	lastKey := ""
+	for n, line := range strings.Split(strings.TrimRight(string(block), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			switch {
+			case lastKey != "":
+				values := header[lastKey]
+				values[len(values)-1] += " " + strings.TrimSpace(line)
+			case len(rawHeaders) > 0:
+				rawHeaders[len(rawHeaders)-1] += "\n" + line
+			default:
+				rawHeaders = append(rawHeaders, line)
+				warnings = append(warnings, fmt.Sprintf("header line %d is a continuation without a field", n+1))
+			}
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found || !validFieldName(name) {
+			rawHeaders = append(rawHeaders, line)
+			warnings = append(warnings, fmt.Sprintf("header line %d is not a valid field", n+1))
+			lastKey = ""
+			continue
+		}
+		lastKey = textproto.CanonicalMIMEHeaderKey(name)
+		header[lastKey] = append(header[lastKey], strings.TrimSpace(value))
+	}
+	return header, body, rawHeaders, warnings
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSalvageHeaders(t *testing.T) {
+	raw := "From test@example.com\n" +
+		"Subject: Quarterly\n" +
+		"  results\n" +
+		"To: a@example.com,\n" +
+		"\tb@example.com\n" +
+		"X Bad Header: value\n" +
+		"  continued\n" +
+		"\n" +
+		"The body\n"
+	header, body, rawHeaders, warnings := salvageHeaders([]byte(raw))
+
+	if got := header.Get("Subject"); got != "Quarterly results" {
+		t.Errorf("salvageHeaders did not unfold the subject. Got: %q", got)
+	}
+	if got := header.Get("To"); got != "a@example.com, b@example.com" {
+		t.Errorf("salvageHeaders did not unfold the recipients. Got: %q", got)
+	}
+	if string(body) != "The body\n" {
+		t.Errorf("salvageHeaders did not return the body. Got: %q", body)
+	}
+	expected := []string{"From test@example.com", "X Bad Header: value\n  continued"}
+	if strings.Join(rawHeaders, "|") != strings.Join(expected, "|") {
+		t.Errorf("salvageHeaders did not keep the unparseable lines. Got: %q, expected: %q", rawHeaders, expected)
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "line 1") || !strings.Contains(warnings[1], "line 6") {
+		t.Errorf("salvageHeaders did not describe the unparseable lines. Got: %q", warnings)
+	}
+}
+
+func TestSalvageHeadersCRLF(t *testing.T) {
+	header, body, rawHeaders, _ := salvageHeaders([]byte("Subject: Test\r\nbroken line\r\n\r\nbody\r\n"))
+	if header.Get("Subject") != "Test" || string(body) != "body\r\n" || len(rawHeaders) != 1 || rawHeaders[0] != "broken line" {
+		t.Errorf("salvageHeaders did not parse CRLF headers. Got: %v, %q, %q", header, body, rawHeaders)
+	}
+}
+
+func TestParseMessageLenient(t *testing.T) {
+	raw := []byte("From test@example.com\nSubject: Test Email\nFrom: Jane <jane@example.com>\n\nThis is a test email")
+
+	// Without lenient the email is ignored with a typed error
+	if _, err := parseMessage(raw, "email.txt", nil, false); !errors.Is(err, errMalformedHeaders) {
+		t.Errorf("parseMessage did not return errMalformedHeaders. Got: %v", err)
+	}
+
+	email, err := parseMessage(raw, "email.txt", nil, true)
+	if err != nil {
+		t.Fatalf("parseMessage returned an error: %v", err)
+	}
+	if email.Subject != "Test Email" || email.Body != "This is a test email" || len(email.From) != 1 || email.From[0].Address != "jane@example.com" {
+		t.Errorf("parseMessage did not keep the valid headers and the body. Got: %s, %q, %v", email.Subject, email.Body, email.From)
+	}
+	if len(email.RawHeaders) != 1 || email.RawHeaders[0] != "From test@example.com" {
+		t.Errorf("parseMessage did not set raw_headers. Got: %q", email.RawHeaders)
+	}
+	if len(email.ParseWarnings) == 0 || !strings.HasPrefix(email.ParseWarnings[0], "malformed headers") {
+		t.Errorf("parseMessage did not set parse_warnings. Got: %q", email.ParseWarnings)
+	}
+
+	// A well formed email has no warnings
+	email, err = parseMessage([]byte("Subject: Fine\n\nbody"), "email.txt", nil, true)
+	if err != nil || email.ParseWarnings != nil || email.RawHeaders != nil {
+		t.Errorf("parseMessage flagged a well formed email. Got: %v, %v", email, err)
+	}
+}
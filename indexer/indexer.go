@@ -2,216 +2,667 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/mail"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
+// Default values of the configuration, see Options
 const (
 	BATCH_SIZE = 10000
-	API_URL    = "http://localhost:4080/api/_bulkv2"
+	ZINC_URL   = "http://localhost:4080/api"
 	INDEX      = "email"
 )
 
 type EmailJson struct {
-	Header map[string][]string `json:"header"`
-	Body   string              `json:"body"`
+	// ID is sent as the Zinc document id, so indexing the same email again overwrites its document
+	ID         string              `json:"_id,omitempty"`
+	Header     map[string][]string `json:"header"`
+	Body       string              `json:"body"`
+	SourcePath string              `json:"source_path"`
+	// SourceOffset is the offset of the message in its mbox file, and nil for a file holding a single email
+	SourceOffset *int64 `json:"source_offset,omitempty"`
+	// Truncated is set when the body was cut to fit in a bulk payload
+	Truncated bool `json:"truncated,omitempty"`
+	// RawHeaders and ParseWarnings are set when the headers were malformed and the email was salvaged
+	RawHeaders    []string `json:"raw_headers,omitempty"`
+	ParseWarnings []string `json:"parse_warnings,omitempty"`
+	// BodyNew, BodyQuoted and Signature split the body by author and Forwarded holds the messages forwarded in it, see splitBody
+	BodyNew    string             `json:"body_new,omitempty"`
+	BodyQuoted string             `json:"body_quoted,omitempty"`
+	Signature  string             `json:"signature,omitempty"`
+	Forwarded  []ForwardedMessage `json:"forwarded,omitempty"`
+	// Attachments lists the MIME parts that are not part of the email text
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Typed fields parsed from the headers, kept alongside the raw header map
+	Date      string    `json:"date,omitempty"`
+	Timestamp string    `json:"@timestamp,omitempty"`
+	From      []Address `json:"from,omitempty"`
+	To        []Address `json:"to,omitempty"`
+	Cc        []Address `json:"cc,omitempty"`
+	Bcc       []Address `json:"bcc,omitempty"`
+	Subject   string    `json:"subject"`
+	MessageID string    `json:"message_id,omitempty"`
+
+	// Mailbox fields derived from the source path, see setMailboxFields
+	Owner      string `json:"owner,omitempty"`
+	FolderPath string `json:"folder_path,omitempty"`
+	Draft      bool   `json:"draft,omitempty"`
+	Flagged    bool   `json:"flagged,omitempty"`
+	Passed     bool   `json:"passed,omitempty"`
+	Replied    bool   `json:"replied,omitempty"`
+	Seen       bool   `json:"seen,omitempty"`
+	Trashed    bool   `json:"trashed,omitempty"`
+
+	// Fields parsed from the X- headers of the Enron corpus, see setEnronFields
+	XFromNames    []string `json:"x_from_names,omitempty"`
+	XToNames      []string `json:"x_to_names,omitempty"`
+	XCcNames      []string `json:"x_cc_names,omitempty"`
+	XBccNames     []string `json:"x_bcc_names,omitempty"`
+	Folder        string   `json:"folder,omitempty"`
+	OriginMailbox string   `json:"origin_mailbox,omitempty"`
+
+	// Thread fields computed over the whole input, see buildThreads. ThreadPosition is 0 for the first email of the thread.
+	ThreadID       string `json:"thread_id,omitempty"`
+	ThreadPosition *int   `json:"thread_position,omitempty"`
 }
 
-// emailPaths returns a list of email file paths in a given directory
-func emailPaths(maildir string) ([]string, error) {
-	// Create a slice to store the emails
-	var emails []string
+// emailPaths walks the maildir directory tree and sends the path of every email file to paths as soon as it is found.
+// Maildir tmp directories and dotfiles are skipped.
+func emailPaths(ctx context.Context, maildir string, paths chan<- string) error {
+	return filepath.WalkDir(maildir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip, err := skipEntry(maildir, path, d); skip || d.IsDir() {
+			return err
+		}
+		select {
+		case paths <- path:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
 
-	// Walk the Maildir directory tree and list the files
-	err := filepath.Walk(maildir, func(path string, info os.FileInfo, err error) error {
+// countEmails walks the maildir directory tree and returns the number of email files, without keeping their paths
+func countEmails(maildir string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(maildir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			emails = append(emails, path)
+		if skip, err := skipEntry(maildir, path, d); skip || d.IsDir() {
+			return err
 		}
+		count++
 		return nil
 	})
-
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return emails, nil
+	return count, nil
+}
+
+// emailID returns a stable document id for an email: its Message-ID without the angle brackets or,
+// when the header is missing, the hex encoded SHA-256 hash of the raw email
+func emailID(header mail.Header, raw []byte) string {
+	id := strings.TrimSpace(header.Get("Message-ID"))
+	id = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">"))
+	if id != "" {
+		return id
+	}
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:])
 }
 
 // parseEmail reads an email file and returns an EmailJson struct
 func parseEmail(filePath string) (*EmailJson, error) {
-	file, err := os.Open(filePath)
+	return parseEmailFile(filePath, false)
+}
+
+// parseEmailFile reads an email file and returns an EmailJson struct, salvaging it if its headers are malformed and lenient is set
+func parseEmailFile(filePath string, lenient bool) (*EmailJson, error) {
+	raw, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		log.Printf("Error opening file %s: %v", filePath, err)
 		return nil, err
 	}
-	defer file.Close()
+	return parseMessage(raw, filePath, nil, lenient)
+}
 
-	msg, err := mail.ReadMessage(file)
-	if err != nil {
-		if strings.Contains(err.Error(), "malformed MIME header") {
-			log.Printf("Email %s ignored due to malformed headers", filePath)
-			return nil, fmt.Errorf("email %s ignored due to malformed headers", filePath)
-		} else {
-			log.Printf("Error reading email %s: %v", filePath, err)
+// sourceName returns the name of an email in logs: its path, followed by its offset for the messages of an mbox file
+func sourceName(path string, offset *int64) string {
+	if offset == nil {
+		return path
+	}
+	return fmt.Sprintf("%s@%d", path, *offset)
+}
+
+// parseMessage parses a raw email read from path, at offset if it comes from an mbox file, and returns an EmailJson struct.
+// An email with malformed headers is ignored with errMalformedHeaders, unless lenient is set and it is salvaged.
+func parseMessage(raw []byte, path string, offset *int64, lenient bool) (*EmailJson, error) {
+	filePath := sourceName(path, offset)
+	var header mail.Header
+	var body []byte
+	var rawHeaders, warnings []string
+	// The email is read from memory, so every error comes from its headers
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	switch {
+	case err == nil:
+		header = msg.Header
+		if body, err = ioutil.ReadAll(msg.Body); err != nil {
 			return nil, err
 		}
+	case lenient:
+		header, body, rawHeaders, warnings = salvageHeaders(raw)
+		warnings = append([]string{"malformed headers: " + err.Error()}, warnings...)
+		log.Printf("Email %s salvaged from malformed headers: %v", filePath, err)
+	default:
+		log.Printf("Email %s ignored due to malformed headers", filePath)
+		return nil, fmt.Errorf("email %s ignored due to %w: %v", filePath, errMalformedHeaders, err)
 	}
 
-	buf := new(strings.Builder)
-	_, err = io.Copy(buf, msg.Body)
-
-	if err != nil {
-		return nil, err
-	}
+	text, attachments := parseBody(header, body)
 	emailJson := &EmailJson{
-		Header: msg.Header,
-		Body:   buf.String(),
+		ID:            emailID(header, raw),
+		Header:        decodeHeaders(header),
+		Body:          text,
+		SourcePath:    path,
+		SourceOffset:  offset,
+		RawHeaders:    rawHeaders,
+		ParseWarnings: warnings,
+		Attachments:   attachments,
 	}
+	setStructuredFields(emailJson, header)
+	setBodyParts(emailJson)
 	return emailJson, nil
 }
 
-// createBatches returns a 2D slice of strings, with each inner slice representing a batch of file paths
-func createBatches(paths []string, batchSize int) ([][]string, error) {
-	numBatches := len(paths) / batchSize
-	if len(paths)%batchSize != 0 {
-		numBatches++
+// batchPaths groups the paths received from in into numbered batches of up to batchSize paths and sends them to batches.
+// The last batch may be smaller. It returns once in is closed and every batch has been sent.
+func batchPaths(ctx context.Context, in <-chan string, batchSize int, batches chan<- batch) error {
+	current := batch{paths: make([]string, 0, batchSize)}
+	send := func() error {
+		select {
+		case batches <- current:
+			current = batch{seq: current.seq + 1, paths: make([]string, 0, batchSize)}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	batches := make([][]string, numBatches)
-	for i := 0; i < numBatches; i++ {
-		start := i * batchSize
-		end := start + batchSize
-		if end > len(paths) {
-			end = len(paths)
+	for path := range in {
+		current.paths = append(current.paths, path)
+		if len(current.paths) == batchSize {
+			if err := send(); err != nil {
+				return err
+			}
 		}
-		batches[i] = paths[start:end]
 	}
-	return batches, nil
-}
-
-// processBatch reads and parses a batch of email files, then uploads the parsed data to the server
-func processBatch(batch []string) error {
-	log.Println("Starting processing of batch")
-	messages, err := parseEmailBatch(batch)
-	if err != nil {
-		return err
+	if len(current.paths) > 0 {
+		return send()
 	}
-	log.Println("Finishing processing of batch")
-	return uploadBatch(API_URL, messages)
+	return nil
 }
 
 // parseEmailBatch reads and parses a batch of email files, returning a slice of EmailJson structs
-func parseEmailBatch(batch []string) ([]*EmailJson, error) {
-	messages := make([]*EmailJson, len(batch))
-	i := 0
-	for _, path := range batch {
-		msg, err := parseEmail(path)
+func parseEmailBatch(paths []string) ([]*EmailJson, error) {
+	return parseBatch(batch{paths: paths}, false, nil), nil
+}
+
+// parseBatch parses the emails of a batch, reading the messages of mbox files from their sections and the emails
+// of archives from the contents held by the batch. Emails with malformed headers are skipped, or salvaged if lenient is set.
+// The skipped emails, and those that could not be read, are added to the report.
+func parseBatch(b batch, lenient bool, report *runReport) []*EmailJson {
+	messages := make([]*EmailJson, 0, len(b.paths))
+	for i, path := range b.paths {
+		var section mboxSection
+		if b.sections != nil {
+			section = b.sections[i]
+		}
+		var msg *EmailJson
+		var err error
+		switch {
+		case b.contents != nil && section.length == 0:
+			msg, err = parseMessage(b.contents[i], path, nil, lenient)
+		case b.contents != nil:
+			msg, err = parseMessage(unquoteMbox(b.contents[i]), path, &section.offset, lenient)
+		case section.length == 0:
+			msg, err = parseEmailFile(path, lenient)
+		default:
+			msg, err = parseMboxMessage(path, section, lenient)
+		}
 		if err != nil {
-			if strings.Contains(err.Error(), "ignored due to malformed headers") {
+			var offset *int64
+			if section.length > 0 {
+				offset = &section.offset
+			}
+			if errors.Is(err, errMalformedHeaders) {
+				report.add(path, offset, ReportMalformedHeader, err.Error())
 				continue
-			} else {
-				log.Printf("Error parsing email %s: %v", path, err)
-				return nil, err
 			}
+			report.add(path, offset, ReportIOError, err.Error())
+			log.Printf("Error parsing email %s: %v", b.name(i), err)
+			continue
 		}
-		messages[i] = msg
-		i++
+		messages = append(messages, msg)
 	}
-	//remove nil entries
-	messages = messages[:i]
-
-	return messages, nil
+	return messages
 }
 
-// uploadBatch uploads a batch of email data to the server
-func uploadBatch(url string, batch []*EmailJson) error {
-	payload := map[string]interface{}{
-		"index":   INDEX,
-		"records": batch,
-	}
-	payloadBytes, err := json.Marshal(payload)
+// encodePayload writes the bulk payload for the records to w one record at a time, so the whole
+// payload is never held in memory
+func encodePayload(w io.Writer, index string, records []*EmailJson) error {
+	indexJSON, err := json.Marshal(index)
 	if err != nil {
 		return err
 	}
+	if _, err := fmt.Fprintf(w, `{"index":%s,"records":[`, indexJSON); err != nil {
+		return err
+	}
+	for i, record := range records {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(payloadBytes))
+// payloadReader returns a reader that streams the bulk payload as it is encoded by a goroutine,
+// compressed with gzip if compress is set. Closing the reader stops the goroutine.
+func payloadReader(index string, records []*EmailJson, compress bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.Writer = pw
+		var gz *gzip.Writer
+		if compress {
+			gz = gzip.NewWriter(pw)
+			w = gz
+		}
+		err := encodePayload(w, index, records)
+		if err == nil && gz != nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// uploadBatch uploads a batch of email data to the index and returns the records the server rejected.
+// The payload is streamed into the request body and, if compress is set, sent gzip encoded.
+func uploadBatch(ctx context.Context, url, index string, auth credentials, batch []*EmailJson, compress bool) ([]recordError, error) {
+	body := payloadReader(index, batch, compress)
+	defer body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	req.SetBasicAuth("admin", "Complexpass#123")
+	if compress {
+		req.Header.Add("Content-Encoding", "gzip")
+	}
+	auth.setAuth(req)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Error uploading batch: %v", err)
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, newStatusError(resp)
 	}
 
-	return nil
+	return parseBulkResponse(resp.Body, len(batch))
 }
 
-// processMaildir reads email files from a given maildir and uploads them to the server
-func processMaildir(maildir string) error {
-	paths, err := emailPaths(maildir)
-	if err != nil {
-		return err
+// maildirSource returns a batch source that walks the maildir and streams its emails in batches of batchSize,
+// reading the files as the given format. If a manifest is given, only the files that are new or modified since
+// the last run are sent.
+func maildirSource(maildir, format string, batchSize int, manifest *Manifest) batchSource {
+	return func(ctx context.Context, batches chan<- batch) error {
+		g, ctx := errgroup.WithContext(ctx)
+		found := make(chan string, batchSize)
+		g.Go(func() error {
+			defer close(found)
+			return emailPaths(ctx, maildir, found)
+		})
+		paths := found
+		if manifest != nil {
+			changed := make(chan string, batchSize)
+			g.Go(func() error {
+				defer close(changed)
+				return manifest.filter(ctx, found, changed)
+			})
+			paths = changed
+		}
+		g.Go(func() error {
+			if format == FormatMaildir {
+				return batchPaths(ctx, paths, batchSize, batches)
+			}
+			return messageBatches(ctx, paths, format, manifest != nil, batchSize, batches)
+		})
+		return g.Wait()
 	}
-	log.Println(len(paths), "emails found.")
+}
 
-	batches, err := createBatches(paths, BATCH_SIZE)
-	if err != nil {
-		return err
+// processMissing reports the files indexed by a previous run that no longer exist and,
+// if requested and supported by the sink, deletes their documents from the index
+func processMissing(ctx context.Context, sink Sink, manifest *Manifest, deleteMissing bool) error {
+	missing := manifest.missing()
+	if len(missing) == 0 {
+		return nil
+	}
+	log.Printf("%d indexed emails no longer exist", len(missing))
+	deleter, ok := sink.(sourceDeleter)
+	if deleteMissing && !ok {
+		log.Println("The sink cannot delete documents, missing emails are only reported")
+	}
+	for _, path := range missing {
+		if !deleteMissing || !ok {
+			log.Printf("Missing email %s", path)
+			continue
+		}
+		deleted, err := deleter.DeleteSource(ctx, path)
+		if err != nil {
+			return fmt.Errorf("error deleting documents of %s: %w", path, err)
+		}
+		log.Printf("Missing email %s, %d documents deleted", path, deleted)
+		manifest.forget(path)
 	}
+	return nil
+}
 
-	totalBatches := len(batches)
-	log.Printf("Processing %d batches\n", totalBatches)
+// processMaildir reads the emails of a maildir, of mbox files or of a tar, tar.gz or zip archive, and uploads them to the server.
+// If sink is nil, the sink of opts is created and closed when the run ends; watch mode passes the sink it writes to.
+func processMaildir(ctx context.Context, maildir string, opts Options, sink Sink) (err error) {
+	if opts.BatchSize < 1 {
+		return fmt.Errorf("invalid batch size %d", opts.BatchSize)
+	}
+	switch opts.Format {
+	case FormatAuto, FormatMaildir:
+	case FormatMbox:
+		if opts.Incremental {
+			return fmt.Errorf("incremental runs do not support mbox files")
+		}
+	default:
+		return fmt.Errorf("unknown format %q", opts.Format)
+	}
+	archive := isArchive(maildir)
+	if archive && opts.Incremental {
+		return fmt.Errorf("incremental runs do not support archives")
+	}
+	alias := ""
+	if opts.Versioned {
+		// A version is always built from scratch, so it cannot be resumed or updated incrementally
+		if opts.Incremental || opts.Resume {
+			return fmt.Errorf("versioned runs cannot be incremental or resumed")
+		}
+		alias = opts.Index
+		opts.Index = versionedIndex(alias, time.Now())
+		log.Printf("Building index %s for alias %s", opts.Index, alias)
+	}
+	totalBatches := 0
+	if opts.Count {
+		count := countMessages
+		if archive {
+			count = countArchiveMessages
+		}
+		total, err := count(maildir, opts.Format)
+		if err != nil {
+			return err
+		}
+		log.Println(total, "emails found.")
+		totalBatches = (total + opts.BatchSize - 1) / opts.BatchSize
+		if opts.Incremental {
+			// Unchanged files are skipped, so the number of batches is not known in advance
+			totalBatches = 0
+		}
+	}
+	if totalBatches > 0 {
+		log.Printf("Processing %d batches with %d parsers and %d uploaders\n", totalBatches, opts.Parsers, opts.Uploaders)
+	} else {
+		log.Printf("Processing batches with %d parsers and %d uploaders\n", opts.Parsers, opts.Uploaders)
+	}
 
-	startTime := time.Now()
-	lastBatchStart := startTime
-	for i, batch := range batches {
-		log.Printf("Processing batch %d of %d...", i+1, totalBatches)
+	checkpointPath := opts.CheckpointPath
+	if checkpointPath == "" {
+		checkpointPath = defaultCheckpointPath(maildir)
+	}
+	checkpoint := newCheckpoint(checkpointPath, maildir, opts.BatchSize)
+	if opts.Resume {
+		checkpoint, err = loadCheckpoint(checkpointPath, maildir, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+	}
 
-		if i > 0 {
-			elapsed := time.Since(startTime)
-			lastBatchTook := time.Since(lastBatchStart)
-			estimatedRemaining := elapsed / time.Duration(i) * time.Duration(totalBatches-i)
-			log.Printf("Last batch: %v, Elapsed time: %v, Estimated time remaining: %v\n", lastBatchTook, elapsed, estimatedRemaining)
-		} else {
-			log.Println()
+	var manifest *Manifest
+	if opts.Incremental {
+		manifestPath := opts.ManifestPath
+		if manifestPath == "" {
+			manifestPath = defaultManifestPath(maildir)
+		}
+		manifest, err = loadManifest(manifestPath)
+		if err != nil {
+			return err
+		}
+		// The manifest is saved even if the run fails, so the files acknowledged so far are not uploaded again
+		defer func() {
+			if saveErr := manifest.save(); saveErr != nil && err == nil {
+				err = fmt.Errorf("error saving manifest: %w", saveErr)
+			}
+		}()
+	}
+
+	if sink == nil {
+		if sink, err = newSink(opts); err != nil {
+			return err
 		}
+		defer func() {
+			if closeErr := sink.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("error closing sink: %w", closeErr)
+			}
+		}()
+	}
+	versioner, ok := sink.(indexVersioner)
+	if opts.Versioned && !ok {
+		return fmt.Errorf("the %s sink does not support versioned indexes", opts.Sink)
+	}
+	// A version whose build fails is deleted, so it is never kept as a rollback target; once it is built,
+	// publishVersion deletes it if it cannot be published
+	publishing := false
+	if opts.Versioned {
+		defer func() {
+			if err != nil && !publishing {
+				discardVersion(context.Background(), versioner, opts.Index)
+			}
+		}()
+	}
 
-		lastBatchStart = time.Now()
-		if err := processBatch(batch); err != nil {
+	if manager, ok := sink.(indexManager); ok && opts.Mapping {
+		if err := manager.EnsureIndex(ctx, opts.RecreateIndex); err != nil {
 			return err
 		}
+	}
 
+	deadLetterPath := opts.DeadLetterPath
+	if deadLetterPath == "" {
+		deadLetterPath = filepath.Clean(maildir) + deadLetterSuffix
+	}
+	deadLetters := newDeadLetters(deadLetterPath)
+	defer deadLetters.Close()
+
+	var report *runReport
+	if opts.ReportPath != "" {
+		report = &runReport{}
+		// The report is written even if the run fails, so the emails that failed it are listed
+		defer func() {
+			if writeErr := report.write(opts.ReportPath); writeErr != nil {
+				if err == nil {
+					err = fmt.Errorf("error writing report: %w", writeErr)
+				}
+				return
+			}
+			log.Printf("Report of %d skipped or failed emails written to %s", len(report.entries), opts.ReportPath)
+		}()
+	}
+
+	source := maildirSource(maildir, opts.Format, opts.BatchSize, manifest)
+	if archive {
+		source = archiveSource(maildir, opts.Format, opts.BatchSize)
+	}
+	root := maildir
+	if archive {
+		root = ""
+	}
+	var threads threadIndex
+	var resolver *threadResolver
+	switch {
+	case !opts.Threads:
+	case opts.Incremental:
+		// Only the changed emails are read, so their threads are looked up in the index
+		if resolver = newSinkThreadResolver(sink, opts); resolver == nil {
+			log.Printf("The %s sink cannot search the indexed emails, threads are not set in incremental runs", opts.Sink)
+		}
+	case archive && !opts.ThreadArchives:
+		log.Println("Threads are not reconstructed for archives unless -thread-archives is set")
+	default:
+		log.Println("Reading headers to reconstruct threads")
+		if threads, err = collectThreads(ctx, source, opts.Parsers, opts.ThreadWindow); err != nil {
+			return fmt.Errorf("error reconstructing threads: %w", err)
+		}
+	}
+	p := &pipeline{
+		sink:         sink,
+		source:       source,
+		root:         root,
+		totalBatches: totalBatches,
+		checkpoint:   checkpoint,
+		manifest:     manifest,
+		deadLetters:  deadLetters,
+		report:       report,
+		threads:      threads,
+		resolver:     resolver,
+		opts:         opts,
+	}
+	if opts.Versioned {
+		p.documents = &documentIDs{}
+	}
+	err = p.run(ctx)
+	log.Printf("Summary: %s", &p.stats)
+	if err != nil {
+		return err
+	}
+	if p.stats.Rejected > 0 {
+		log.Printf("Rejected emails were written to %s", deadLetterPath)
+	}
+
+	if manifest != nil {
+		stats := manifest.stats
+		log.Printf("%d new, %d modified and %d unchanged emails", stats.New, stats.Modified, stats.Unchanged)
+		if err := processMissing(ctx, sink, manifest, opts.DeleteMissing); err != nil {
+			return err
+		}
+	}
+	if opts.Versioned {
+		publishing = true
+		if err := publishVersion(ctx, versioner, alias, opts.Index, p.documents.count(), opts.Retention, opts.RecreateIndex, opts.Retry); err != nil {
+			return err
+		}
 	}
 	log.Println("Process completed.")
 	return nil
 }
 
 func main() {
+	opts := DefaultOptions()
+	flag.String(configFlag, "", "YAML config file whose keys are flag names (default $"+envName(configFlag)+")")
+	flag.StringVar(&opts.ZincURL, "url", opts.ZincURL, "base URL of the Zinc API")
+	flag.StringVar(&opts.Index, "index", opts.Index, "name of the index")
+	flag.StringVar(&opts.Username, "user", opts.Username, "username of the server")
+	flag.StringVar(&opts.Password, "password", "", "password of the server, prefer -password-file or $"+envName("password")+" to keep it out of the shell history")
+	flag.StringVar(&opts.PasswordFile, "password-file", "", "file holding the password of the server")
+	flag.IntVar(&opts.Parsers, "parsers", opts.Parsers, "number of goroutines parsing email batches")
+	flag.IntVar(&opts.Uploaders, "uploaders", opts.Uploaders, "number of goroutines uploading batches to the server")
+	flag.IntVar(&opts.QueueSize, "queue", opts.QueueSize, "number of parsed batches that can wait for an uploader")
+	flag.StringVar(&opts.CheckpointPath, "checkpoint", "", "path of the checkpoint file (default <maildir>"+checkpointSuffix+")")
+	flag.BoolVar(&opts.Resume, "resume", false, "skip the batches acknowledged in the checkpoint by a previous run")
+	flag.BoolVar(&opts.Incremental, "incremental", false, "only index the emails that are new or modified since the last run")
+	flag.StringVar(&opts.ManifestPath, "manifest", "", "path of the manifest used by incremental runs (default <maildir>"+manifestSuffix+")")
+	flag.BoolVar(&opts.DeleteMissing, "delete-missing", false, "with -incremental, delete from the index the emails whose files no longer exist")
+	flag.BoolVar(&opts.Mapping, "mapping", opts.Mapping, "create the index with mapping.json, or check that the existing index matches it")
+	flag.BoolVar(&opts.RecreateIndex, "recreate-index", false, "delete and recreate the index if its mapping does not match mapping.json; with -versioned, replace an index that has the name of the alias")
+	flag.BoolVar(&opts.Versioned, "versioned", false, "build a new version of the index and point -index, as an alias, at it once its document count is validated")
+	flag.IntVar(&opts.Retention, "retention", opts.Retention, "number of previously published versions of a versioned index to keep")
+	flag.IntVar(&opts.RecordRetries, "record-retries", opts.RecordRetries, "number of times the records rejected by the server are sent again")
+	flag.StringVar(&opts.ReportPath, "report", "", "write a report of the skipped and failed emails with totals per category, as CSV if the path ends in .csv and JSON otherwise")
+	flag.StringVar(&opts.DeadLetterPath, "dead-letter", "", "NDJSON file where the records rejected by the server are written (default <maildir>"+deadLetterSuffix+")")
+	flag.IntVar(&opts.Retry.MaxAttempts, "retry-attempts", opts.Retry.MaxAttempts, "maximum number of attempts to upload a batch")
+	flag.DurationVar(&opts.Retry.BaseDelay, "retry-delay", opts.Retry.BaseDelay, "base delay between upload attempts, doubled on every attempt")
+	flag.DurationVar(&opts.Retry.MaxDelay, "retry-max-delay", opts.Retry.MaxDelay, "maximum delay between upload attempts")
+	flag.BoolVar(&opts.Lenient, "lenient", opts.Lenient, "salvage the emails with malformed headers, keeping the unparseable lines in raw_headers, instead of skipping them")
+	flag.StringVar(&opts.Format, "format", opts.Format, "format of the input files: "+FormatAuto+", "+FormatMaildir+" or "+FormatMbox)
+	flag.IntVar(&opts.BatchSize, "batch-size", opts.BatchSize, "maximum number of emails in a batch")
+	flag.IntVar(&opts.BatchBytes, "batch-bytes", opts.BatchBytes, "maximum size in bytes of a bulk payload, 0 for no limit")
+	flag.StringVar(&opts.Oversized, "oversized", opts.Oversized, "policy for a single email bigger than -batch-bytes: "+OversizedTruncate+" or "+OversizedReject)
+	flag.BoolVar(&opts.Gzip, "gzip", false, "compress bulk payloads with gzip")
+	flag.StringVar(&opts.Sink, "sink", opts.Sink, "where documents are sent: "+strings.Join([]string{SinkZinc, SinkElasticsearch, SinkFile, SinkStdout}, ", "))
+	flag.StringVar(&opts.SinkURL, "sink-url", opts.SinkURL, "base URL of the "+SinkElasticsearch+" sink")
+	flag.StringVar(&opts.Output, "output", "", "NDJSON file written by the "+SinkFile+" sink")
+	flag.BoolVar(&opts.Watch, "watch", false, "after indexing the maildir, keep indexing the emails delivered, moved or deleted until interrupted; with -incremental, the manifest also records the changes indexed while watching, so restarts skip the unchanged emails")
+	flag.DurationVar(&opts.WatchDebounce, "watch-debounce", opts.WatchDebounce, "how long a file must go without changes before it is indexed in watch mode")
+	flag.BoolVar(&opts.Threads, "threads", opts.Threads, "set thread_id and thread_position; full runs read every email twice and keep the headers of the whole input in memory, -incremental and -watch runs look up the threads in the index of the "+SinkZinc+" sink")
+	flag.BoolVar(&opts.ThreadArchives, "thread-archives", false, "with -threads, also reconstruct the threads of archives, which are then decompressed twice")
+	flag.DurationVar(&opts.ThreadWindow, "thread-window", opts.ThreadWindow, "maximum time between a reply without In-Reply-To or References and the earlier email with the same subject")
+	flag.BoolVar(&opts.Count, "count", opts.Count, "count the emails before indexing to report progress and the estimated time remaining; archives are decompressed one more time to count them")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s <maildir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <maildir, mbox or archive>\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEvery flag can also be set with a %s<FLAG> environment variable, e.g. %s, or in the config file.\n", envPrefix, envName("batch-size"))
+		fmt.Fprintln(os.Stderr, "Flags take precedence over environment variables, which take precedence over the config file.")
 	}
 	flag.Parse()
+	if err := applyConfig(flag.CommandLine, os.LookupEnv); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
 	maildir := flag.Arg(0)
 	if maildir == "" {
 		fmt.Println("Error: No maildir path provided")
@@ -221,7 +672,14 @@ func main() {
 
 	log.Println("Starting the program")
 	start := time.Now()
-	err := processMaildir(maildir)
+	var err error
+	if opts.Watch {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err = watchMaildir(ctx, maildir, opts)
+		stop()
+	} else {
+		err = processMaildir(context.Background(), maildir, opts, nil)
+	}
 	if err != nil {
 		log.Println("Error processing maildir: ", err)
 		os.Exit(1)
@@ -1,12 +1,55 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 )
 
+// collectPaths runs emailPaths and returns every path it streamed
+func collectPaths(maildir string) ([]string, error) {
+	paths := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(paths)
+		errc <- emailPaths(context.Background(), maildir, paths)
+	}()
+
+	var emails []string
+	for path := range paths {
+		emails = append(emails, path)
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// collectBatches runs batchPaths over the given paths and returns every batch it produced
+func collectBatches(paths []string, batchSize int) ([][]string, error) {
+	in := make(chan string, len(paths))
+	for _, path := range paths {
+		in <- path
+	}
+	close(in)
+
+	out := make(chan batch, len(paths)+1)
+	err := batchPaths(context.Background(), in, batchSize, out)
+	close(out)
+
+	var batches [][]string
+	for b := range out {
+		batches = append(batches, b.paths)
+	}
+	return batches, err
+}
+
 func TestEmailPaths(t *testing.T) {
 	// Create a temporary directory for testing
 	tempDir, _ := ioutil.TempDir("", "maildir")
@@ -17,7 +60,7 @@ func TestEmailPaths(t *testing.T) {
 	ioutil.WriteFile(tempDir+"/email2.txt", []byte("test email 2"), 0644)
 
 	// Test emailPaths function
-	emails, err := emailPaths(tempDir)
+	emails, err := collectPaths(tempDir)
 	if err != nil {
 		t.Errorf("emailPaths returned an error: %v", err)
 	}
@@ -48,19 +91,51 @@ func TestParseEmail(t *testing.T) {
 	}
 }
 
-func TestCreateBatches(t *testing.T) {
+func TestBatchPaths(t *testing.T) {
 	paths := []string{"path1", "path2", "path3", "path4", "path5"}
 
-	// Test createBatches function
-	batches, err := createBatches(paths, 5)
+	// Test batchPaths function
+	batches, err := collectBatches(paths, 5)
 	if err != nil {
-		t.Errorf("createBatches returned an error: %v", err)
+		t.Errorf("batchPaths returned an error: %v", err)
 	}
 	if len(batches) != 1 {
-		t.Errorf("createBatches did not return the correct number of batches. Got: %d, expected: 1", len(batches))
+		t.Errorf("batchPaths did not return the correct number of batches. Got: %d, expected: 1", len(batches))
 	}
 	if len(batches[0]) != 5 {
-		t.Errorf("createBatches did not return the correct number of paths in the first batch. Got: %d, expected: 5", len(batches[0]))
+		t.Errorf("batchPaths did not return the correct number of paths in the first batch. Got: %d, expected: 5", len(batches[0]))
+	}
+}
+
+func TestBatchPathsRemainder(t *testing.T) {
+	paths := []string{"path1", "path2", "path3", "path4", "path5"}
+
+	// Test batchPaths function with a batch size that does not divide the number of paths
+	batches, err := collectBatches(paths, 2)
+	if err != nil {
+		t.Errorf("batchPaths returned an error: %v", err)
+	}
+	if len(batches) != 3 {
+		t.Errorf("batchPaths did not return the correct number of batches. Got: %d, expected: 3", len(batches))
+	}
+	if len(batches[2]) != 1 || batches[2][0] != "path5" {
+		t.Errorf("batchPaths did not put the remaining path in the last batch. Got: %v, expected: [path5]", batches[2])
+	}
+}
+
+func TestCountEmails(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	os.Mkdir(tempDir+"/inbox", 0755)
+	ioutil.WriteFile(tempDir+"/email1.txt", []byte("test email 1"), 0644)
+	ioutil.WriteFile(tempDir+"/inbox/email2.txt", []byte("test email 2"), 0644)
+
+	count, err := countEmails(tempDir)
+	if err != nil {
+		t.Errorf("countEmails returned an error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("countEmails did not return the correct number of emails. Got: %d, expected: 2", count)
 	}
 }
 
@@ -90,7 +165,7 @@ func TestParseEmailBatch(t *testing.T) {
 
 func TestEmailPathsInvalidDir(t *testing.T) {
 	// Pass an invalid directory path to the emailPaths function
-	emails, err := emailPaths("/invalid/directory")
+	emails, err := collectPaths("/invalid/directory")
 
 	// Check if the function returns an error
 	if err == nil {
@@ -109,7 +184,7 @@ func TestEmailPathsEmptyDir(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Pass the empty directory to the emailPaths function
-	emails, err := emailPaths(tempDir)
+	emails, err := collectPaths(tempDir)
 
 	// Check if the function returns an error
 	if err != nil {
@@ -122,6 +197,29 @@ func TestEmailPathsEmptyDir(t *testing.T) {
 	}
 }
 
+func TestParseEmailID(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	ioutil.WriteFile(tempDir+"/email1.txt", []byte("Message-ID: <12345.JavaMail.evans@thyme>\nSubject: Test Email\n\ntest email"), 0644)
+	ioutil.WriteFile(tempDir+"/email2.txt", []byte("Subject: Test Email\n\ntest email"), 0644)
+
+	// The Message-ID is used as the document id
+	email, err := parseEmail(tempDir + "/email1.txt")
+	if err != nil {
+		t.Fatalf("parseEmail returned an error: %v", err)
+	}
+	if email.ID != "12345.JavaMail.evans@thyme" {
+		t.Errorf("parseEmail did not return the Message-ID as the id. Got: %s, expected: 12345.JavaMail.evans@thyme", email.ID)
+	}
+
+	// Without a Message-ID the id is a hash of the contents, stable across runs
+	first, _ := parseEmail(tempDir + "/email2.txt")
+	second, _ := parseEmail(tempDir + "/email2.txt")
+	if len(first.ID) != 64 || first.ID != second.ID {
+		t.Errorf("parseEmail did not return a stable hash id. Got: %s and %s", first.ID, second.ID)
+	}
+}
+
 func TestParseEmailMalformedFile(t *testing.T) {
 	// Create a test email file with malformed headers
 	tempFile, _ := ioutil.TempFile("", "email")
@@ -146,27 +244,27 @@ func TestUploadBatchError(t *testing.T) {
 		},
 	}
 	url := "http://invalid.server"
-	err := uploadBatch(url, emails)
+	_, err := uploadBatch(context.Background(), url, INDEX, credentials{}, emails, false)
 	if err == nil {
 		t.Error("uploadBatch did not return an error for an invalid server URL")
 	}
 }
 
-func TestCreateBatchesLargeBatchSize(t *testing.T) {
+func TestBatchPathsLargeBatchSize(t *testing.T) {
 	paths := []string{"path1", "path2"}
 
-	// Test createBatches function
-	batches, err := createBatches(paths, 5)
+	// Test batchPaths function
+	batches, err := collectBatches(paths, 5)
 	if err != nil {
-		t.Errorf("createBatches returned an error: %v", err)
+		t.Errorf("batchPaths returned an error: %v", err)
 	}
 
 	// Check if the function returns a single batch containing all the email files
 	if len(batches) != 1 {
-		t.Errorf("createBatches did not return a single batch")
+		t.Errorf("batchPaths did not return a single batch")
 	}
 	if len(batches[0]) != 2 {
-		t.Errorf("createBatches did not return all the email files in the first batch. Got: %d, expected: 2", len(batches[0]))
+		t.Errorf("batchPaths did not return all the email files in the first batch. Got: %d, expected: 2", len(batches[0]))
 	}
 }
 
@@ -190,5 +288,54 @@ func TestParseEmailBatchMalformedHeaders(t *testing.T) {
 
 func BenchmarkProcessMaildir(b *testing.B) {
 	maildir := "../enron_mail_20110402/maildir"
-	processMaildir(maildir)
+	processMaildir(context.Background(), maildir, DefaultOptions(), nil)
+}
+
+func TestEncodePayload(t *testing.T) {
+	emails := []*EmailJson{
+		{ID: "1", Body: "test email 1"},
+		{ID: "2", Body: "test email 2 <html> & \"quotes\""},
+	}
+
+	// The streamed payload is the same as the marshalled one
+	var buf strings.Builder
+	if err := encodePayload(&buf, INDEX, emails); err != nil {
+		t.Fatalf("encodePayload returned an error: %v", err)
+	}
+	expected, _ := json.Marshal(map[string]interface{}{"index": INDEX, "records": emails})
+	if buf.String() != string(expected) {
+		t.Errorf("encodePayload did not write the expected payload.\nGot:      %s\nExpected: %s", buf.String(), expected)
+	}
+	if payloadSize := buf.Len(); payloadSize != payloadOverhead(INDEX)+encodedSize(emails[0])+encodedSize(emails[1])+1 {
+		t.Errorf("encodePayload wrote %d bytes, which does not match the size used to split batches", payloadSize)
+	}
+}
+
+func TestUploadBatchGzip(t *testing.T) {
+	var received struct {
+		Index   string       `json:"index"`
+		Records []*EmailJson `json:"records"`
+	}
+	var encoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(gz).Decode(&received)
+	}))
+	defer ts.Close()
+
+	emails := []*EmailJson{{ID: "1", Body: "test email 1"}}
+	if _, err := uploadBatch(context.Background(), ts.URL, INDEX, credentials{}, emails, true); err != nil {
+		t.Fatalf("uploadBatch returned an error: %v", err)
+	}
+	if encoding != "gzip" {
+		t.Errorf("uploadBatch did not set the Content-Encoding header. Got: %q", encoding)
+	}
+	if received.Index != INDEX || len(received.Records) != 1 || received.Records[0].Body != "test email 1" {
+		t.Errorf("uploadBatch did not send the compressed payload. Got: %+v", received)
+	}
 }
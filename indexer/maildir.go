@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maildirTmp is the Maildir directory where emails are written during delivery, so its files may be incomplete
+const maildirTmp = "tmp"
+
+// skipEntry reports whether a walked entry of the maildir at root is not an email: a Maildir tmp directory, which
+// is skipped with fs.SkipDir, or a dotfile
+func skipEntry(root, path string, d fs.DirEntry) (bool, error) {
+	if path == root {
+		return false, nil
+	}
+	if d.IsDir() {
+		if d.Name() == maildirTmp {
+			return true, fs.SkipDir
+		}
+		return false, nil
+	}
+	return strings.HasPrefix(d.Name(), "."), nil
+}
+
+// skipArchivePath reports whether an archive entry is not an email: a file inside a Maildir tmp directory, or a dotfile
+func skipArchivePath(name string) bool {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for _, dir := range parts[:len(parts)-1] {
+		if dir == maildirTmp {
+			return true
+		}
+	}
+	return strings.HasPrefix(parts[len(parts)-1], ".")
+}
+
+// maildirFlags are the flags of the Maildir info suffix, as in "1234.host:2,FRS"
+var maildirFlags = map[byte]func(*EmailJson){
+	'D': func(e *EmailJson) { e.Draft = true },
+	'F': func(e *EmailJson) { e.Flagged = true },
+	'P': func(e *EmailJson) { e.Passed = true },
+	'R': func(e *EmailJson) { e.Replied = true },
+	'S': func(e *EmailJson) { e.Seen = true },
+	'T': func(e *EmailJson) { e.Trashed = true },
+}
+
+// setMaildirFlags sets the flags of the email from the info suffix of its file name. Windows uses "!" instead of ":".
+func setMaildirFlags(email *EmailJson, name string) {
+	i := strings.LastIndex(name, ":2,")
+	if j := strings.LastIndex(name, "!2,"); j > i {
+		i = j
+	}
+	if i < 0 {
+		return
+	}
+	for _, c := range []byte(name[i+3:]) {
+		if set, ok := maildirFlags[c]; ok {
+			set(email)
+		}
+	}
+}
+
+// setMailboxFields sets the Maildir flags of the email and derives its owner and folder path from its source
+// path relative to root, e.g. allen-p/sent_items/1. is owned by allen-p in folder allen-p/sent_items. The cur and
+// new directories of a Maildir are not part of the folder. An empty root means the source path is already
+// relative, as for archive entries, where everything up to the first maildir directory is dropped too, so
+// enron_mail_20110402/maildir/allen-p/inbox/1. is owned by allen-p.
+func setMailboxFields(email *EmailJson, root string) {
+	if email.SourceOffset == nil {
+		setMaildirFlags(email, filepath.Base(email.SourcePath))
+	}
+
+	rel := filepath.ToSlash(email.SourcePath)
+	if root != "" {
+		var err error
+		if rel, err = filepath.Rel(root, email.SourcePath); err != nil {
+			return
+		}
+		rel = filepath.ToSlash(rel)
+	} else {
+		parts := strings.Split(rel, "/")
+		for i, part := range parts[:len(parts)-1] {
+			if strings.EqualFold(part, "maildir") {
+				rel = strings.Join(parts[i+1:], "/")
+				break
+			}
+		}
+	}
+	folder := path.Dir(rel)
+	if base := path.Base(folder); base == "cur" || base == "new" {
+		folder = path.Dir(folder)
+	}
+	if folder == "." || path.IsAbs(folder) || strings.HasPrefix(folder, "..") {
+		return
+	}
+	email.FolderPath = folder
+	email.Owner = strings.SplitN(folder, "/", 2)[0]
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEmailPathsSkipsTmpAndDotfiles(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	for _, name := range []string{"allen-p/cur/1:2,S", "allen-p/new/2", "allen-p/tmp/3", "allen-p/.uidvalidity", "allen-p/.Sent/cur/4"} {
+		path := filepath.Join(tempDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte("Subject: test\n\nbody"), 0644)
+	}
+
+	paths := make(chan string, 10)
+	if err := emailPaths(context.Background(), tempDir, paths); err != nil {
+		t.Fatalf("emailPaths returned an error: %v", err)
+	}
+	close(paths)
+	var found []string
+	for path := range paths {
+		rel, _ := filepath.Rel(tempDir, path)
+		found = append(found, filepath.ToSlash(rel))
+	}
+	sort.Strings(found)
+
+	// Dot directories are Maildir++ folders, so only dotfiles are skipped
+	expected := []string{"allen-p/.Sent/cur/4", "allen-p/cur/1:2,S", "allen-p/new/2"}
+	if strings.Join(found, ",") != strings.Join(expected, ",") {
+		t.Errorf("emailPaths did not skip tmp and dotfiles. Got: %v, expected: %v", found, expected)
+	}
+	if count, err := countEmails(tempDir); err != nil || count != 3 {
+		t.Errorf("countEmails did not skip tmp and dotfiles. Got: %d, %v", count, err)
+	}
+}
+
+func TestSkipArchivePath(t *testing.T) {
+	tests := map[string]bool{
+		"maildir/allen-p/inbox/1.":  false,
+		"maildir/allen-p/tmp/1.":    true,
+		"maildir/allen-p/.DS_Store": true,
+		"maildir/allen-p/tmp":       false,
+		"maildir/.Sent/cur/1":       false,
+	}
+	for name, expected := range tests {
+		if got := skipArchivePath(name); got != expected {
+			t.Errorf("skipArchivePath(%s) = %v, expected: %v", name, got, expected)
+		}
+	}
+}
+
+func TestSetMaildirFlags(t *testing.T) {
+	email := &EmailJson{}
+	setMaildirFlags(email, "1204680122.27c448.host:2,FRST")
+	if !email.Flagged || !email.Replied || !email.Seen || !email.Trashed || email.Draft || email.Passed {
+		t.Errorf("setMaildirFlags did not parse the flags. Got: %+v", email)
+	}
+
+	email = &EmailJson{}
+	setMaildirFlags(email, "1204680122.27c448.host!2,D")
+	if !email.Draft || email.Seen {
+		t.Errorf("setMaildirFlags did not parse the Windows separator. Got: %+v", email)
+	}
+
+	email = &EmailJson{}
+	setMaildirFlags(email, "1.")
+	if email.Draft || email.Flagged || email.Passed || email.Replied || email.Seen || email.Trashed {
+		t.Errorf("setMaildirFlags set flags for a file name without info. Got: %+v", email)
+	}
+}
+
+func TestSetMailboxFields(t *testing.T) {
+	root := filepath.Join("data", "maildir")
+	tests := []struct {
+		sourcePath string
+		root       string
+		owner      string
+		folder     string
+	}{
+		{filepath.Join(root, "allen-p", "sent_items", "1."), root, "allen-p", "allen-p/sent_items"},
+		{filepath.Join(root, "allen-p", "inbox", "cur", "2:2,S"), root, "allen-p", "allen-p/inbox"},
+		{filepath.Join(root, "3."), root, "", ""},
+		{"maildir/lay-k/deleted_items/4.", "", "lay-k", "lay-k/deleted_items"},
+		{"enron_mail_20110402/maildir/allen-p/inbox/1.", "", "allen-p", "allen-p/inbox"},
+		{"exports/archive.mbox", "", "exports", "exports"},
+	}
+	for _, test := range tests {
+		email := &EmailJson{SourcePath: test.sourcePath}
+		setMailboxFields(email, test.root)
+		if email.Owner != test.owner || email.FolderPath != test.folder {
+			t.Errorf("setMailboxFields(%s) set owner %q and folder %q, expected: %q and %q", test.sourcePath, email.Owner, email.FolderPath, test.owner, test.folder)
+		}
+	}
+
+	email := &EmailJson{SourcePath: filepath.Join(root, "allen-p", "inbox", "cur", "2:2,RS")}
+	setMailboxFields(email, root)
+	if !email.Seen || !email.Replied {
+		t.Errorf("setMailboxFields did not set the flags. Got: %+v", email)
+	}
+}
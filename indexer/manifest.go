@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// manifestSuffix is appended to the maildir path to build the default manifest path
+const manifestSuffix = ".manifest.json"
+
+// manifestEntry describes an email file as it was when it was last indexed
+type manifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash"`
+}
+
+// Manifest records the files indexed by previous runs, so only new or modified files are parsed and uploaded again
+type Manifest struct {
+	Files map[string]manifestEntry `json:"files"`
+
+	path string
+	mu   sync.Mutex
+	// seen holds the files found by the current walk
+	seen map[string]bool
+	// pending holds the entries of new or modified files until the server acknowledges them
+	pending map[string]manifestEntry
+	// replaced holds the modified files whose old documents must be deleted before they are uploaded again
+	replaced map[string]bool
+	// stats counts the files found by the current walk
+	stats manifestStats
+}
+
+// manifestStats counts the files found by an incremental walk
+type manifestStats struct {
+	New       int
+	Modified  int
+	Unchanged int
+}
+
+// defaultManifestPath returns the manifest path used for a maildir when none is given
+func defaultManifestPath(maildir string) string {
+	return filepath.Clean(maildir) + manifestSuffix
+}
+
+// newManifest returns an empty manifest that will be saved to path
+func newManifest(path string) *Manifest {
+	return &Manifest{
+		Files:    map[string]manifestEntry{},
+		path:     path,
+		seen:     map[string]bool{},
+		pending:  map[string]manifestEntry{},
+		replaced: map[string]bool{},
+	}
+}
+
+// loadManifest reads the manifest at path. If the file does not exist an empty manifest is returned,
+// so the first incremental run indexes every file.
+func loadManifest(path string) (*Manifest, error) {
+	manifest := newManifest(path)
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No manifest found at %s, every email will be indexed", path)
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %w", path, err)
+	}
+	if manifest.Files == nil {
+		manifest.Files = map[string]manifestEntry{}
+	}
+	log.Printf("Loaded manifest %s with %d files", path, len(manifest.Files))
+	return manifest, nil
+}
+
+// save writes the manifest atomically
+func (m *Manifest) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, data)
+}
+
+// hashFile returns the hex encoded SHA-256 hash of the file contents
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// check compares a file with its manifest entry and reports whether it has to be indexed.
+// Files with the same size and modification time are trusted to be unchanged; otherwise the
+// contents are hashed, so a file that was only touched is not uploaded again.
+func (m *Manifest) check(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	old, exists := m.Files[path]
+	m.seen[path] = true
+	m.mu.Unlock()
+
+	if exists && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+		m.mu.Lock()
+		m.stats.Unchanged++
+		m.mu.Unlock()
+		return false, nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return false, err
+	}
+	entry := manifestEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case exists && old.Hash == hash:
+		m.Files[path] = entry
+		m.stats.Unchanged++
+		return false, nil
+	case exists:
+		m.pending[path] = entry
+		m.replaced[path] = true
+		m.stats.Modified++
+	default:
+		m.pending[path] = entry
+		m.stats.New++
+	}
+	return true, nil
+}
+
+// filter reads paths from in and sends to out only the files that are new or modified since the last run
+func (m *Manifest) filter(ctx context.Context, in <-chan string, out chan<- string) error {
+	for path := range in {
+		changed, err := m.check(path)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		select {
+		case out <- path:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// replacedPaths returns the paths of the batch whose documents from a previous run must be deleted
+func (m *Manifest) replacedPaths(b batch) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var paths []string
+	for _, path := range b.paths {
+		if m.replaced[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// acknowledge records the files of the emails indexed by the server
+func (m *Manifest) acknowledge(emails []*EmailJson) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, email := range emails {
+		path := email.SourcePath
+		if entry, ok := m.pending[path]; ok {
+			m.Files[path] = entry
+			delete(m.pending, path)
+			delete(m.replaced, path)
+		}
+	}
+}
+
+// track records the current state of a file written while watching, so it is added to the manifest once the
+// server acknowledges it. The watcher deletes the old documents of a modified file itself, so it is not replaced.
+func (m *Manifest) track(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[path] = manifestEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+	return nil
+}
+
+// missing returns, in order, the files indexed by a previous run that were not found by the current walk
+func (m *Manifest) missing() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var paths []string
+	for path := range m.Files {
+		if !m.seen[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// forget removes a file from the manifest once its documents have been deleted from the index
+func (m *Manifest) forget(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.Files, path)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// incrementalRun indexes the maildir with the manifest at path and returns the loaded manifest
+func incrementalRun(t *testing.T, zincURL, maildir, path string) *Manifest {
+	manifest, err := loadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pipeline{sink: newZincSink(zincURL, INDEX, credentials{}, false), source: maildirSource(maildir, FormatMaildir, 10, manifest), manifest: manifest, opts: DefaultOptions()}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatalf("pipeline.run returned an error: %v", err)
+	}
+	if err := manifest.save(); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestIncrementalRun(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	paths := writeTestEmails(t, tempDir, 3)
+	manifestPath := filepath.Join(os.TempDir(), filepath.Base(tempDir)+manifestSuffix)
+	defer os.Remove(manifestPath)
+
+	// Record the uploaded files and the deleted documents
+	var mu sync.Mutex
+	var uploaded []string
+	deletes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_search"):
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"hits": map[string]interface{}{
+					"hits": []map[string]interface{}{
+						{"_id": "1", "_source": map[string]string{"source_path": paths[1]}},
+					},
+				},
+			})
+		case r.Method == "DELETE":
+			deletes++
+		default:
+			var payload struct {
+				Records []*EmailJson `json:"records"`
+			}
+			json.NewDecoder(r.Body).Decode(&payload)
+			for _, record := range payload.Records {
+				uploaded = append(uploaded, record.SourcePath)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	// The first run indexes every file
+	manifest := incrementalRun(t, ts.URL, tempDir, manifestPath)
+	if len(uploaded) != 3 || manifest.stats.New != 3 {
+		t.Fatalf("the first incremental run did not index every email. Got: %d, expected: 3", len(uploaded))
+	}
+
+	// Modify one file, touch another without changing it and add a new one
+	uploaded = nil
+	ioutil.WriteFile(paths[1], []byte("From: test@example.com\nSubject: Changed\n\nchanged"), 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(paths[2], later, later)
+	ioutil.WriteFile(filepath.Join(tempDir, "new.txt"), []byte("From: test@example.com\nSubject: New\n\nnew"), 0644)
+
+	manifest = incrementalRun(t, ts.URL, tempDir, manifestPath)
+	if len(uploaded) != 2 {
+		t.Errorf("the second incremental run did not only index the new and modified emails. Got: %v", uploaded)
+	}
+	if manifest.stats.New != 1 || manifest.stats.Modified != 1 || manifest.stats.Unchanged != 2 {
+		t.Errorf("unexpected incremental stats: %+v", manifest.stats)
+	}
+	if deletes != 1 {
+		t.Errorf("the old document of the modified email was not deleted. Got: %d deletes, expected: 1", deletes)
+	}
+
+	// Remove a file, it must be reported as missing
+	os.Remove(paths[0])
+	manifest = incrementalRun(t, ts.URL, tempDir, manifestPath)
+	missing := manifest.missing()
+	if len(missing) != 1 || missing[0] != paths[0] {
+		t.Errorf("missing did not return the removed email. Got: %v, expected: [%s]", missing, paths[0])
+	}
+}
+
+func TestManifestCheckUnchangedHash(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	paths := writeTestEmails(t, tempDir, 1)
+
+	manifest := newManifest(filepath.Join(tempDir, "manifest.json"))
+	hash, _ := hashFile(paths[0])
+	manifest.Files[paths[0]] = manifestEntry{Size: 1, ModTime: time.Unix(0, 0), Hash: hash}
+
+	// Same contents with a different size and time in the manifest must not be indexed again
+	changed, err := manifest.check(paths[0])
+	if err != nil {
+		t.Fatalf("check returned an error: %v", err)
+	}
+	if changed {
+		t.Errorf("check reported a file with the same contents as changed")
+	}
+}
+
+func TestIncrementalRunRejectedStayPending(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	paths := writeTestEmails(t, tempDir, 3)
+	manifestPath := filepath.Join(os.TempDir(), filepath.Base(tempDir)+manifestSuffix)
+	defer os.Remove(manifestPath)
+
+	// email1 is rejected on the first run only
+	ts := rejectingServer(map[string]int{"email1.txt": 2})
+	defer ts.Close()
+
+	manifest := incrementalRun(t, ts.URL, tempDir, manifestPath)
+	if _, ok := manifest.Files[paths[1]]; ok || len(manifest.Files) != 2 {
+		t.Errorf("the manifest recorded a rejected email as indexed. Got: %d files", len(manifest.Files))
+	}
+
+	// The next run sends the rejected email again
+	manifest = incrementalRun(t, ts.URL, tempDir, manifestPath)
+	if manifest.stats.New != 1 || manifest.stats.Unchanged != 2 || len(manifest.Files) != 3 {
+		t.Errorf("the rejected email was not indexed again. Got: %+v, %d files", manifest.stats, len(manifest.Files))
+	}
+}
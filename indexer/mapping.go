@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// mappingJSON is the index definition the indexer writes to. It is versioned in mapping.json
+// so changes to field types are reviewed like any other code change.
+//
+//go:embed mapping.json
+var mappingJSON []byte
+
+// mappingProperty is the definition of a field in a Zinc index mapping
+type mappingProperty struct {
+	Type          string `json:"type"`
+	Format        string `json:"format,omitempty"`
+	Analyzer      string `json:"analyzer,omitempty"`
+	Index         bool   `json:"index"`
+	Store         bool   `json:"store"`
+	Sortable      bool   `json:"sortable"`
+	Aggregatable  bool   `json:"aggregatable"`
+	Highlightable bool   `json:"highlightable"`
+}
+
+// indexMapping is the field mapping of a Zinc index
+type indexMapping struct {
+	Properties map[string]mappingProperty `json:"properties"`
+}
+
+// indexDefinition holds the settings and mapping used to create the index
+type indexDefinition struct {
+	Settings json.RawMessage `json:"settings,omitempty"`
+	Mappings indexMapping    `json:"mappings"`
+}
+
+// loadIndexDefinition parses the embedded index definition
+func loadIndexDefinition() (*indexDefinition, error) {
+	var definition indexDefinition
+	if err := json.Unmarshal(mappingJSON, &definition); err != nil {
+		return nil, fmt.Errorf("error reading mapping.json: %w", err)
+	}
+	return &definition, nil
+}
+
+// conflicts returns, in order, the fields whose type, format, analyzer or index, store, sortable and aggregatable
+// flags differ between the mapping and the existing one. Fields missing from the existing mapping are not
+// conflicts, they can be added.
+func (m indexMapping) conflicts(existing indexMapping) []string {
+	var fields []string
+	for name, want := range m.Properties {
+		got, ok := existing.Properties[name]
+		if !ok {
+			continue
+		}
+		if got.Type != want.Type ||
+			(want.Format != "" && got.Format != want.Format) ||
+			(want.Analyzer != "" && got.Analyzer != want.Analyzer) ||
+			got.Index != want.Index || got.Store != want.Store ||
+			got.Sortable != want.Sortable || got.Aggregatable != want.Aggregatable {
+			fields = append(fields, fmt.Sprintf("%s (%s, expected %s)", name, describeProperty(got), describeProperty(want)))
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// missing returns the properties of the mapping that are not in the existing one
+func (m indexMapping) missing(existing indexMapping) indexMapping {
+	missing := indexMapping{Properties: map[string]mappingProperty{}}
+	for name, property := range m.Properties {
+		if _, ok := existing.Properties[name]; !ok {
+			missing.Properties[name] = property
+		}
+	}
+	return missing
+}
+
+// describeProperty returns a short description of a property for error messages
+func describeProperty(p mappingProperty) string {
+	parts := []string{p.Type}
+	if p.Format != "" {
+		parts = append(parts, "format "+p.Format)
+	}
+	if p.Analyzer != "" {
+		parts = append(parts, "analyzer "+p.Analyzer)
+	}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{{"index", p.Index}, {"store", p.Store}, {"sortable", p.Sortable}, {"aggregatable", p.Aggregatable}} {
+		if flag.set {
+			parts = append(parts, flag.name)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// indexExists reports whether the index exists in Zinc
+func indexExists(ctx context.Context, zincURL, index string, auth credentials) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", zincURL+"/index/"+index, nil)
+	if err != nil {
+		return false, err
+	}
+	auth.setAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code checking index %s: %d", index, resp.StatusCode)
+	}
+}
+
+// createIndex creates the index with the given definition
+func createIndex(ctx context.Context, zincURL, index string, auth credentials, definition *indexDefinition) error {
+	body := map[string]interface{}{
+		"name":         index,
+		"storage_type": "disk",
+		"mappings":     definition.Mappings,
+	}
+	if len(definition.Settings) > 0 {
+		body["settings"] = definition.Settings
+	}
+	return zincRequest(ctx, auth, "POST", zincURL+"/index", body, nil)
+}
+
+// ensureIndex creates the index with the mapping in mapping.json, or checks that the mapping of the
+// existing index matches it and adds the fields it lacks. An index with conflicting field types is
+// refused, unless recreate is set: then it is deleted, with all its documents, and created again.
+func ensureIndex(ctx context.Context, zincURL, index string, auth credentials, recreate bool) error {
+	definition, err := loadIndexDefinition()
+	if err != nil {
+		return err
+	}
+
+	exists, err := indexExists(ctx, zincURL, index, auth)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.Printf("Creating index %s", index)
+		return createIndex(ctx, zincURL, index, auth, definition)
+	}
+
+	var response map[string]struct {
+		Mappings indexMapping `json:"mappings"`
+	}
+	if err := zincRequest(ctx, auth, "GET", zincURL+"/"+index+"/_mapping", nil, &response); err != nil {
+		return err
+	}
+	existing := response[index].Mappings
+
+	if conflicts := definition.Mappings.conflicts(existing); len(conflicts) > 0 {
+		if !recreate {
+			return fmt.Errorf("the mapping of index %s does not match mapping.json: %s; use -recreate-index to delete and recreate it", index, strings.Join(conflicts, ", "))
+		}
+		log.Printf("Recreating index %s, its mapping does not match: %s", index, strings.Join(conflicts, ", "))
+		if err := deleteIndex(ctx, zincURL, index, auth); err != nil {
+			return err
+		}
+		return createIndex(ctx, zincURL, index, auth, definition)
+	}
+
+	if missing := definition.Mappings.missing(existing); len(missing.Properties) > 0 {
+		log.Printf("Adding %d fields to the mapping of index %s", len(missing.Properties), index)
+		return zincRequest(ctx, auth, "PUT", zincURL+"/"+index+"/_mapping", missing, nil)
+	}
+	return nil
+}
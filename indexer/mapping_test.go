@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeIndexServer emulates the Zinc index API for a single index and records the requests it gets
+type fakeIndexServer struct {
+	exists   bool
+	mapping  indexMapping
+	requests []string
+}
+
+func (f *fakeIndexServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	switch {
+	case r.Method == "HEAD":
+		if !f.exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/_mapping"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"email": map[string]interface{}{"mappings": f.mapping}})
+	case r.Method == "DELETE":
+		f.exists = false
+	case r.Method == "POST":
+		f.exists = true
+	}
+}
+
+func TestLoadIndexDefinition(t *testing.T) {
+	definition, err := loadIndexDefinition()
+	if err != nil {
+		t.Fatalf("loadIndexDefinition returned an error: %v", err)
+	}
+	if definition.Mappings.Properties["date"].Type != "date" {
+		t.Errorf("mapping.json does not map date as a date field")
+	}
+	if definition.Mappings.Properties["message_id"].Type != "keyword" {
+		t.Errorf("mapping.json does not map message_id as a keyword field")
+	}
+}
+
+func TestEnsureIndexCreates(t *testing.T) {
+	fake := &fakeIndexServer{}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	if err := ensureIndex(context.Background(), ts.URL, "email", credentials{}, false); err != nil {
+		t.Fatalf("ensureIndex returned an error: %v", err)
+	}
+	if !fake.exists {
+		t.Errorf("ensureIndex did not create the missing index")
+	}
+}
+
+func TestEnsureIndexAddsMissingFields(t *testing.T) {
+	fake := &fakeIndexServer{exists: true, mapping: indexMapping{Properties: map[string]mappingProperty{
+		"body": {Type: "text", Analyzer: "email_text", Index: true},
+	}}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	if err := ensureIndex(context.Background(), ts.URL, "email", credentials{}, false); err != nil {
+		t.Fatalf("ensureIndex returned an error: %v", err)
+	}
+	if last := fake.requests[len(fake.requests)-1]; last != "PUT /email/_mapping" {
+		t.Errorf("ensureIndex did not update the mapping. Last request: %s", last)
+	}
+}
+
+func TestEnsureIndexConflict(t *testing.T) {
+	fake := &fakeIndexServer{exists: true, mapping: indexMapping{Properties: map[string]mappingProperty{
+		"date": {Type: "text"},
+	}}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	// A conflicting mapping is refused
+	err := ensureIndex(context.Background(), ts.URL, "email", credentials{}, false)
+	if err == nil || !strings.Contains(err.Error(), "date") {
+		t.Errorf("ensureIndex did not refuse an index with a conflicting mapping. Got: %v", err)
+	}
+
+	// Unless the index may be recreated
+	if err := ensureIndex(context.Background(), ts.URL, "email", credentials{}, true); err != nil {
+		t.Fatalf("ensureIndex returned an error: %v", err)
+	}
+	requests := strings.Join(fake.requests, ",")
+	if !strings.Contains(requests, "DELETE /index/email") || !fake.exists {
+		t.Errorf("ensureIndex did not recreate the index. Requests: %s", requests)
+	}
+}
+
+func TestIndexMappingConflictsFlags(t *testing.T) {
+	definition, err := loadIndexDefinition()
+	if err != nil {
+		t.Fatalf("loadIndexDefinition returned an error: %v", err)
+	}
+	existing := indexMapping{Properties: map[string]mappingProperty{}}
+	for name, property := range definition.Mappings.Properties {
+		existing.Properties[name] = property
+	}
+	if conflicts := definition.Mappings.conflicts(existing); len(conflicts) != 0 {
+		t.Errorf("conflicts found differences in an identical mapping. Got: %v", conflicts)
+	}
+
+	// Fields that are not aggregatable or not stored cannot be used as mapping.json expects
+	address := existing.Properties["from.address"]
+	address.Aggregatable = false
+	existing.Properties["from.address"] = address
+	subject := existing.Properties["subject"]
+	subject.Store = false
+	existing.Properties["subject"] = subject
+	conflicts := definition.Mappings.conflicts(existing)
+	if len(conflicts) != 2 || !strings.HasPrefix(conflicts[0], "from.address") || !strings.HasPrefix(conflicts[1], "subject") {
+		t.Errorf("conflicts did not compare the field flags. Got: %v", conflicts)
+	}
+}
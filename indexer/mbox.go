@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// FormatAuto reads a file as mbox if it starts with a "From " line, and as a single email otherwise
+	FormatAuto = "auto"
+	// FormatMaildir reads every file as a single email
+	FormatMaildir = "maildir"
+	// FormatMbox reads every file as an mbox holding many emails
+	FormatMbox = "mbox"
+)
+
+// mboxSeparator starts the line that precedes every message of an mbox file
+var mboxSeparator = []byte("From ")
+
+// mboxSection is the part of an mbox file holding one message, starting at its "From " line.
+// A zero length section stands for a whole file holding a single email.
+type mboxSection struct {
+	offset int64
+	length int64
+}
+
+// isMbox reports whether the file starts with an mbox "From " line
+func isMbox(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	prefix := make([]byte, len(mboxSeparator))
+	if _, err := io.ReadFull(file, prefix); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(prefix, mboxSeparator), nil
+}
+
+// mboxSections reads the mbox file sequentially and calls fn with the section of every message as soon as
+// its end is found, so files of any size are split without holding them in memory
+func mboxSections(path string, fn func(mboxSection) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return scanMbox(file, path, false, func(section mboxSection, _ []byte) error {
+		return fn(section)
+	})
+}
+
+// scanMbox reads an mbox named name from r and calls fn with the section of every message as soon as its end
+// is found. If keep is set fn also gets the raw message, otherwise only the current line is held in memory.
+// A "From " line only starts a message at the beginning of the mbox or after a blank line; quoted ">From "
+// lines never do.
+func scanMbox(r io.Reader, name string, keep bool, fn func(mboxSection, []byte) error) error {
+	reader := bufio.NewReaderSize(r, 64<<10)
+	var offset int64
+	var data []byte
+	start := int64(-1)
+	lineStart, prevBlank := true, true
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			if lineStart {
+				if prevBlank && bytes.HasPrefix(line, mboxSeparator) {
+					if start >= 0 {
+						if err := fn(mboxSection{offset: start, length: offset - start}, data); err != nil {
+							return err
+						}
+					} else if offset > 0 {
+						log.Printf("Ignoring %d bytes before the first message of %s", offset, name)
+					}
+					start = offset
+					data = nil
+				}
+				prevBlank = line[len(line)-1] == '\n' && len(bytes.TrimRight(line, "\r\n")) == 0
+			} else {
+				prevBlank = false
+			}
+			if keep && start >= 0 {
+				data = append(data, line...)
+			}
+			offset += int64(len(line))
+			// Lines longer than the buffer are read in several pieces
+			lineStart = line[len(line)-1] == '\n'
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if start < 0 {
+		log.Printf("No messages found in mbox %s", name)
+		return nil
+	}
+	return fn(mboxSection{offset: start, length: offset - start}, data)
+}
+
+// unquoteMbox drops the "From " line of a raw mbox message and the blank line that separates it from the next
+// one, and removes a ">" from the lines starting with ">From ", ">>From " and so on. This is the mboxrd quoting,
+// and it also undoes the ">From " quoting of mboxo files.
+func unquoteMbox(data []byte) []byte {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	} else {
+		data = nil
+	}
+	if bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+		data = data[:len(data)-2]
+	} else if bytes.HasSuffix(data, []byte("\n\n")) {
+		data = data[:len(data)-1]
+	}
+
+	unquoted := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+		if unescaped := bytes.TrimLeft(line, ">"); len(unescaped) < len(line) && bytes.HasPrefix(unescaped, mboxSeparator) {
+			line = line[1:]
+		}
+		unquoted = append(unquoted, line...)
+	}
+	return unquoted
+}
+
+// parseMboxMessage reads the message of an mbox file at the given section and returns an EmailJson struct,
+// salvaging it if its headers are malformed and lenient is set
+func parseMboxMessage(path string, section mboxSection, lenient bool) (*EmailJson, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Error opening file %s: %v", path, err)
+		return nil, err
+	}
+	defer file.Close()
+
+	data := make([]byte, section.length)
+	if _, err := file.ReadAt(data, section.offset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading message at offset %d of %s: %w", section.offset, path, err)
+	}
+	offset := section.offset
+	return parseMessage(unquoteMbox(data), path, &offset, lenient)
+}
+
+// messageBatches groups the files received from in into numbered batches of up to batchSize emails, splitting
+// mbox files into their messages. Incremental runs track whole files, so they cannot include mbox files.
+func messageBatches(ctx context.Context, in <-chan string, format string, incremental bool, batchSize int, batches chan<- batch) error {
+	current := batch{}
+	send := func() error {
+		select {
+		case batches <- current:
+			current = batch{seq: current.seq + 1}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	add := func(path string, section mboxSection) error {
+		current.paths = append(current.paths, path)
+		current.sections = append(current.sections, section)
+		if len(current.paths) == batchSize {
+			return send()
+		}
+		return nil
+	}
+
+	for path := range in {
+		mbox := format == FormatMbox
+		if format == FormatAuto {
+			var err error
+			if mbox, err = isMbox(path); err != nil {
+				return err
+			}
+		}
+		if !mbox {
+			if err := add(path, mboxSection{}); err != nil {
+				return err
+			}
+			continue
+		}
+		if incremental {
+			return fmt.Errorf("incremental runs do not support mbox files: %s", path)
+		}
+		if err := mboxSections(path, func(section mboxSection) error {
+			return add(path, section)
+		}); err != nil {
+			return err
+		}
+	}
+	if len(current.paths) > 0 {
+		return send()
+	}
+	return nil
+}
+
+// countMessages walks the input and returns the number of emails it holds, counting the messages of mbox files
+func countMessages(input, format string) (int, error) {
+	if format == FormatMaildir {
+		return countEmails(input)
+	}
+	count := 0
+	err := filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip, err := skipEntry(input, path, d); skip || d.IsDir() {
+			return err
+		}
+		mbox := format == FormatMbox
+		if format == FormatAuto {
+			if mbox, err = isMbox(path); err != nil {
+				return err
+			}
+		}
+		if !mbox {
+			count++
+			return nil
+		}
+		return mboxSections(path, func(mboxSection) error {
+			count++
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testMbox holds three messages: the body of the first one has an mboxrd quoted line and a
+// "From " line that does not follow a blank line, so it does not start a message
+const testMbox = "From alice@example.com Mon Oct  2 10:00:00 2023\n" +
+	"Message-ID: <1@example.com>\n" +
+	"From: alice@example.com\n" +
+	"Subject: First\n" +
+	"\n" +
+	"Hello\n" +
+	">From the archive\n" +
+	">>From the nested archive\n" +
+	"From the start of a line\n" +
+	"\n" +
+	"From bob@example.com Mon Oct  2 11:00:00 2023\n" +
+	"Message-ID: <2@example.com>\n" +
+	"From: bob@example.com\n" +
+	"Subject: Second\n" +
+	"\n" +
+	"Bye\n" +
+	"\n" +
+	"From carol@example.com Mon Oct  2 12:00:00 2023\n" +
+	"From: carol@example.com\n" +
+	"Subject: Third\n" +
+	"\n" +
+	"No message id\n"
+
+// writeTestMbox writes testMbox to dir and returns its path
+func writeTestMbox(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "archive.mbox")
+	if err := ioutil.WriteFile(path, []byte(testMbox), 0644); err != nil {
+		t.Fatalf("error writing test mbox: %v", err)
+	}
+	return path
+}
+
+func TestMboxSections(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "mbox")
+	defer os.RemoveAll(tempDir)
+	path := writeTestMbox(t, tempDir)
+
+	var sections []mboxSection
+	if err := mboxSections(path, func(section mboxSection) error {
+		sections = append(sections, section)
+		return nil
+	}); err != nil {
+		t.Fatalf("mboxSections returned an error: %v", err)
+	}
+	if len(sections) != 3 {
+		t.Fatalf("mboxSections did not split the messages. Got: %d sections, expected: 3", len(sections))
+	}
+	end := int64(0)
+	for i, section := range sections {
+		if section.offset != end || !strings.HasPrefix(testMbox[section.offset:], "From ") {
+			t.Errorf("section %d does not start at a From line. Got offset: %d", i, section.offset)
+		}
+		end = section.offset + section.length
+	}
+	if end != int64(len(testMbox)) {
+		t.Errorf("mboxSections did not cover the whole file. Got: %d bytes, expected: %d", end, len(testMbox))
+	}
+}
+
+func TestUnquoteMbox(t *testing.T) {
+	raw := "From alice@example.com Mon Oct  2 10:00:00 2023\r\nSubject: Test\r\n\r\n>From here\r\n>>From there\r\n>Quoted\r\n\r\n"
+	expected := "Subject: Test\r\n\r\nFrom here\r\n>From there\r\n>Quoted\r\n"
+	if got := string(unquoteMbox([]byte(raw))); got != expected {
+		t.Errorf("unquoteMbox did not unquote the message. Got: %q, expected: %q", got, expected)
+	}
+}
+
+func TestIsMbox(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "mbox")
+	defer os.RemoveAll(tempDir)
+	mbox := writeTestMbox(t, tempDir)
+	email := filepath.Join(tempDir, "email.txt")
+	ioutil.WriteFile(email, []byte("From: test@example.com\n\nbody"), 0644)
+	empty := filepath.Join(tempDir, "empty")
+	ioutil.WriteFile(empty, nil, 0644)
+
+	for path, expected := range map[string]bool{mbox: true, email: false, empty: false} {
+		if got, err := isMbox(path); err != nil || got != expected {
+			t.Errorf("isMbox(%s) = %v, %v, expected: %v", filepath.Base(path), got, err, expected)
+		}
+	}
+}
+
+func TestMaildirSourceMbox(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "mbox")
+	defer os.RemoveAll(tempDir)
+	mbox := writeTestMbox(t, tempDir)
+	ioutil.WriteFile(filepath.Join(tempDir, "email.txt"), []byte("From: test@example.com\nSubject: Single\n\nbody"), 0644)
+
+	// The mbox is split into its messages and the other file is read as a single email
+	batches := make(chan batch, 10)
+	if err := maildirSource(tempDir, FormatAuto, 2, nil)(context.Background(), batches); err != nil {
+		t.Fatalf("maildirSource returned an error: %v", err)
+	}
+	close(batches)
+	var emails []*EmailJson
+	for b := range batches {
+		emails = append(emails, parseBatch(b, false, nil)...)
+	}
+	if len(emails) != 4 {
+		t.Fatalf("maildirSource did not find every email. Got: %d, expected: 4", len(emails))
+	}
+
+	first := emails[0]
+	if first.SourcePath != mbox || first.SourceOffset == nil || *first.SourceOffset != 0 || first.ID != "1@example.com" {
+		t.Errorf("the first mbox message does not record its source. Got: %s, %v, %s", first.SourcePath, first.SourceOffset, first.ID)
+	}
+	expectedBody := "Hello\nFrom the archive\n>From the nested archive\nFrom the start of a line\n"
+	if first.Body != expectedBody {
+		t.Errorf("the first mbox message was not unquoted. Got: %q, expected: %q", first.Body, expectedBody)
+	}
+	if third := emails[2]; third.Subject != "Third" || third.SourceOffset == nil || !strings.HasPrefix(testMbox[*third.SourceOffset:], "From carol") {
+		t.Errorf("the third mbox message does not record its offset. Got: %s, %v", third.Subject, third.SourceOffset)
+	}
+	if single := emails[3]; single.Subject != "Single" || single.SourceOffset != nil {
+		t.Errorf("the single email was not read as a whole file. Got: %s, %v", single.Subject, single.SourceOffset)
+	}
+
+	if count, err := countMessages(tempDir, FormatAuto); err != nil || count != 4 {
+		t.Errorf("countMessages did not count the mbox messages. Got: %d, %v", count, err)
+	}
+}
+
+func TestMaildirSourceMboxIncremental(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "mbox")
+	defer os.RemoveAll(tempDir)
+	writeTestMbox(t, tempDir)
+
+	manifest := newManifest(filepath.Join(tempDir, "manifest.json"))
+	batches := make(chan batch, 10)
+	if err := maildirSource(tempDir, FormatAuto, 2, manifest)(context.Background(), batches); err == nil {
+		t.Errorf("maildirSource did not return an error for an mbox file in an incremental run")
+	}
+}
+
+func TestRecordForMbox(t *testing.T) {
+	b := batch{paths: []string{"a.mbox", "a.mbox"}, sections: []mboxSection{{offset: 0, length: 10}, {offset: 10, length: 5}}}
+	if record := recordFor(b); record.First != "a.mbox@0" || record.Last != "a.mbox@10" {
+		t.Errorf("recordFor did not identify the mbox messages. Got: %+v", record)
+	}
+}
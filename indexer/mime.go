@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// maxMIMEDepth limits how deeply nested multipart entities are walked
+const maxMIMEDepth = 10
+
+// Attachment describes a MIME part that is not part of the email text
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// mimeHeader is implemented by both mail.Header and textproto.MIMEHeader
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// mimeBody accumulates the text parts and attachments found while walking a MIME tree
+type mimeBody struct {
+	plain       []string
+	html        []string
+	attachments []Attachment
+}
+
+// parseBody decodes an email body according to its MIME headers. Multipart bodies are walked and every
+// part is decoded from its Content-Transfer-Encoding and charset. The text/plain parts are returned as
+// the text; if there are none, the text/html parts are converted to text instead. Any other part is
+// returned as an attachment. If the MIME structure is broken the raw body is returned, so no email is lost.
+func parseBody(header mimeHeader, raw []byte) (string, []Attachment) {
+	body := &mimeBody{}
+	if err := body.walk(header, bytes.NewReader(raw), 0); err != nil {
+		return toUTF8("", raw), nil
+	}
+
+	var text string
+	switch {
+	case len(body.plain) > 0:
+		text = strings.Join(body.plain, "\n")
+	case len(body.html) > 0:
+		text = htmlToText(strings.Join(body.html, "\n"))
+	}
+	return text, body.attachments
+}
+
+// walk decodes a MIME entity and its children
+func (b *mimeBody) walk(header mimeHeader, r io.Reader, depth int) error {
+	if depth > maxMIMEDepth {
+		return errors.New("MIME structure is too deeply nested")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// A missing or invalid Content-Type means plain text (RFC 2045, section 5.2)
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		reader := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := b.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), r))
+	if err != nil && len(data) == 0 {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = decodeHeaderValue(filename)
+
+	switch {
+	case disposition != "attachment" && mediaType == "text/plain":
+		b.plain = append(b.plain, toUTF8(params["charset"], data))
+	case disposition != "attachment" && mediaType == "text/html":
+		b.html = append(b.html, toUTF8(params["charset"], data))
+	default:
+		b.attachments = append(b.attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			Size:        len(data),
+		})
+	}
+	return nil
+}
+
+// transferDecoder returns a reader that decodes r according to the Content-Transfer-Encoding.
+// 7bit, 8bit, binary and unknown encodings are returned unchanged.
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// base64Cleaner drops the line breaks and whitespace that base64 bodies are wrapped with
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		kept := 0
+		for _, ch := range p[:n] {
+			if ch != '\r' && ch != '\n' && ch != ' ' && ch != '\t' {
+				p[kept] = ch
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// htmlToText extracts the readable text of an HTML document, dropping scripts and styles
+// and breaking lines at block elements
+func htmlToText(document string) string {
+	var text strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	skip := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return collapseBlankLines(text.String())
+		case html.TextToken:
+			if skip == 0 {
+				text.WriteString(strings.Join(strings.Fields(string(tokenizer.Text())), " "))
+				text.WriteString(" ")
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				skip++
+			case "br", "p", "div", "tr", "li", "h1", "h2", "h3", "h4", "h5", "h6", "table", "blockquote":
+				text.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				if skip > 0 {
+					skip--
+				}
+			case "p", "div", "tr", "li", "h1", "h2", "h3", "h4", "h5", "h6", "table", "blockquote":
+				text.WriteString("\n")
+			}
+		}
+	}
+}
+
+// collapseBlankLines trims every line and removes the empty ones left by the markup
+func collapseBlankLines(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// testHeader builds a header for parseBody
+func testHeader(contentType, encoding string) mail.Header {
+	header := mail.Header{"Content-Type": {contentType}}
+	if encoding != "" {
+		header["Content-Transfer-Encoding"] = []string{encoding}
+	}
+	return header
+}
+
+func TestParseBodyPlain(t *testing.T) {
+	text, attachments := parseBody(mail.Header{}, []byte("This is a test email"))
+	if text != "This is a test email" {
+		t.Errorf("parseBody changed a plain body. Got: %s", text)
+	}
+	if len(attachments) != 0 {
+		t.Errorf("parseBody returned attachments for a plain body")
+	}
+}
+
+func TestParseBodyQuotedPrintable(t *testing.T) {
+	body := "caf=C3=A9 with a soft=\r\n break"
+	text, _ := parseBody(testHeader("text/plain; charset=utf-8", "quoted-printable"), []byte(body))
+	if text != "café with a soft break" {
+		t.Errorf("parseBody did not decode quoted-printable. Got: %q, expected: %q", text, "café with a soft break")
+	}
+}
+
+func TestParseBodyMultipart(t *testing.T) {
+	body := strings.Join([]string{
+		"--outer",
+		"Content-Type: multipart/alternative; boundary=inner",
+		"",
+		"--inner",
+		"Content-Type: text/plain",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"VGhpcyBpcyB0aGUg",
+		"dGV4dA==",
+		"--inner",
+		"Content-Type: text/html",
+		"",
+		"<p>This is the html</p>",
+		"--inner--",
+		"--outer",
+		"Content-Type: application/pdf; name=\"report.pdf\"",
+		"Content-Disposition: attachment; filename=\"report.pdf\"",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"JVBERi0xLjQK",
+		"--outer--",
+		"",
+	}, "\r\n")
+
+	text, attachments := parseBody(testHeader("multipart/mixed; boundary=outer", ""), []byte(body))
+	if text != "This is the text" {
+		t.Errorf("parseBody did not prefer the decoded text/plain part. Got: %q, expected: %q", text, "This is the text")
+	}
+	if len(attachments) != 1 {
+		t.Fatalf("parseBody did not return the attachment. Got: %d, expected: 1", len(attachments))
+	}
+	expected := Attachment{Filename: "report.pdf", ContentType: "application/pdf", Size: 9}
+	if attachments[0] != expected {
+		t.Errorf("parseBody returned the wrong attachment metadata. Got: %+v, expected: %+v", attachments[0], expected)
+	}
+}
+
+func TestParseBodyHTMLFallback(t *testing.T) {
+	body := "<html><head><style>p {}</style></head><body><p>Hello &amp; welcome</p><p>Second</p></body></html>"
+	text, _ := parseBody(testHeader("text/html", ""), []byte(body))
+	if text != "Hello & welcome\nSecond" {
+		t.Errorf("parseBody did not convert the html body to text. Got: %q", text)
+	}
+}
+
+func TestParseBodyBrokenMultipart(t *testing.T) {
+	body := "--missing\r\nno end of headers"
+	text, _ := parseBody(testHeader("multipart/mixed; boundary=missing", ""), []byte(body))
+	if text != body {
+		t.Errorf("parseBody did not fall back to the raw body. Got: %q", text)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Options holds the configuration of the indexer: the server and index, the size of each stage of the pipeline,
+// and how incremental runs, retries and parse errors are handled
+type Options struct {
+	// ZincURL is the base URL of the Zinc API, e.g. http://localhost:4080/api
+	ZincURL string
+	// Index is the index the emails are written to
+	Index string
+	// Username and Password are the basic auth credentials of the server
+	Username string
+	Password string
+	// PasswordFile is a file holding the password, so it stays out of the command line
+	PasswordFile string
+	// Parsers is the number of goroutines reading and parsing batches of email files
+	Parsers int
+	// Uploaders is the number of goroutines sending parsed batches to the server
+	Uploaders int
+	// QueueSize is the number of parsed batches that can wait for an uploader.
+	// Once the queue is full the parsers block, so memory stays bounded.
+	QueueSize int
+	// Count enables a first pass over the input that counts the emails, so progress can be reported with an ETA.
+	// It is off by default, since an archive is decompressed once more to count its entries.
+	Count bool
+	// CheckpointPath is where acknowledged batches are recorded. Defaults to a file next to the maildir.
+	CheckpointPath string
+	// Resume skips the batches recorded in the checkpoint by a previous run
+	Resume bool
+	// Incremental only indexes the files that are new or modified since the last run, according to the manifest
+	Incremental bool
+	// ManifestPath is where the indexed files are recorded. Defaults to a file next to the maildir.
+	ManifestPath string
+	// DeleteMissing deletes from the index the documents whose files no longer exist
+	DeleteMissing bool
+	// Mapping creates the index with the mapping in mapping.json, or checks the mapping of the existing index
+	Mapping bool
+	// RecreateIndex deletes and recreates an existing index whose mapping does not match
+	RecreateIndex bool
+	// RecordRetries is how many times the records rejected by the server are sent again
+	RecordRetries int
+	// DeadLetterPath is the NDJSON file where rejected records are written. Defaults to a file next to the maildir.
+	DeadLetterPath string
+	// Retry controls how uploads that fail with network errors, 429 or 5xx responses are retried
+	Retry retryPolicy
+	// Lenient salvages the emails with malformed headers instead of skipping them
+	Lenient bool
+	// ReportPath, if set, is where the report of the skipped and failed emails is written, as CSV if it ends in .csv and JSON otherwise
+	ReportPath string
+	// Format is the format of the input files: FormatAuto, FormatMaildir or FormatMbox
+	Format string
+	// BatchSize is the maximum number of emails in a batch
+	BatchSize int
+	// BatchBytes is the maximum size of a bulk payload. Batches are split to stay under it; zero means no limit.
+	BatchBytes int
+	// Oversized is the policy for a document bigger than BatchBytes on its own: OversizedTruncate or OversizedReject
+	Oversized string
+	// Gzip sends the bulk payloads with gzip Content-Encoding
+	Gzip bool
+	// Sink selects where the documents are sent: SinkZinc, SinkElasticsearch, SinkFile or SinkStdout
+	Sink string
+	// SinkURL is the base URL of the Elasticsearch sink
+	SinkURL string
+	// Output is the path of the NDJSON file written by the file sink
+	Output string
+	// Versioned builds a new version of the index, e.g. email_v20261017093000, and points Index, used as an
+	// alias, at it once its document count is validated
+	Versioned bool
+	// Retention is how many previously published versions of a versioned index are kept for rollback
+	Retention int
+	// Watch keeps indexing the emails delivered to the maildir after the initial run, until interrupted
+	Watch bool
+	// WatchDebounce is how long a file must go without events before it is indexed in watch mode
+	WatchDebounce time.Duration
+	// Threads sets the conversation thread of every email. Full runs read the headers of every email first, so the
+	// input is read twice and a threadMessage of every email is held in memory until the threads are built.
+	// Incremental and watch runs look up the threads of the new emails in the index instead.
+	Threads bool
+	// ThreadArchives reconstructs the threads of archives too, which are then decompressed twice
+	ThreadArchives bool
+	// ThreadWindow is the maximum time between a reply matched by subject and the earlier email it answers
+	ThreadWindow time.Duration
+}
+
+// batch is a group of email file paths that are parsed and uploaded together.
+// Sources number their batches in order so checkpoints can refer to them.
+type batch struct {
+	seq   int
+	paths []string
+	// sections, if not nil, locates the email of every path inside its file, for the messages of mbox files
+	sections []mboxSection
+	// contents, if not nil, holds the raw email of every path, for the emails read from an archive
+	contents [][]byte
+}
+
+// name returns the name of the email i of the batch: its path, followed by its offset for mbox messages
+func (b batch) name(i int) string {
+	if b.sections == nil || b.sections[i].length == 0 {
+		return b.paths[i]
+	}
+	return sourceName(b.paths[i], &b.sections[i].offset)
+}
+
+// parsedBatch holds the emails parsed from a batch
+type parsedBatch struct {
+	batch
+	messages []*EmailJson
+}
+
+// batchSource produces batches of email file paths and sends them to batches.
+// It must return when ctx is cancelled; the pipeline closes batches once it returns.
+type batchSource func(ctx context.Context, batches chan<- batch) error
+
+// DefaultOptions returns the pipeline options used when no flags are given
+func DefaultOptions() Options {
+	return Options{
+		ZincURL:       ZINC_URL,
+		Index:         INDEX,
+		Username:      "admin",
+		Parsers:       runtime.NumCPU(),
+		Uploaders:     2,
+		QueueSize:     2,
+		Mapping:       true,
+		RecordRetries: 1,
+		Lenient:       true,
+		Format:        FormatAuto,
+		BatchSize:     BATCH_SIZE,
+		BatchBytes:    32 << 20,
+		Oversized:     OversizedTruncate,
+		Sink:          SinkZinc,
+		SinkURL:       "http://localhost:9200",
+		Retention:     2,
+		WatchDebounce: 2 * time.Second,
+		Threads:       true,
+		ThreadWindow:  7 * 24 * time.Hour,
+		Retry: retryPolicy{
+			MaxAttempts: 5,
+			BaseDelay:   500 * time.Millisecond,
+			MaxDelay:    30 * time.Second,
+		},
+	}
+}
+
+// progress logs how many batches have been uploaded and estimates the time remaining.
+// When the total is unknown (zero) only the elapsed time is logged.
+type progress struct {
+	mu        sync.Mutex
+	total     int
+	done      int
+	startTime time.Time
+	lastDone  time.Time
+}
+
+func newProgress(total int) *progress {
+	now := time.Now()
+	return &progress{total: total, startTime: now, lastDone: now}
+}
+
+// batchSkipped removes a batch that does not need to be uploaded from the total
+func (p *progress) batchSkipped() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total--
+}
+
+// batchDone records a finished batch and logs the elapsed and estimated remaining time
+func (p *progress) batchDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	elapsed := time.Since(p.startTime)
+	lastBatchTook := time.Since(p.lastDone)
+	p.lastDone = time.Now()
+	if p.total <= 0 {
+		log.Printf("Uploaded batch %d. Last batch: %v, Elapsed time: %v\n", p.done, lastBatchTook, elapsed)
+		return
+	}
+	estimatedRemaining := elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)
+	log.Printf("Uploaded batch %d of %d. Last batch: %v, Elapsed time: %v, Estimated time remaining: %v\n", p.done, p.total, lastBatchTook, elapsed, estimatedRemaining)
+}
+
+// pipeline parses the batches produced by a source and writes them to a sink
+type pipeline struct {
+	// sink receives the parsed emails
+	sink Sink
+	// source produces the batches to index
+	source batchSource
+	// root is the directory the source paths are relative to, used to derive the mailbox fields of the emails.
+	// It is empty when the source paths are already relative, as for archive entries.
+	root string
+	// totalBatches is the expected number of batches, or zero if unknown
+	totalBatches int
+	// checkpoint, if not nil, skips the batches acknowledged by a previous run and records the uploaded ones
+	checkpoint *Checkpoint
+	// manifest, if not nil, records the uploaded files for incremental runs
+	manifest *Manifest
+	// deadLetters, if not nil, receives the records the server rejected
+	deadLetters *deadLetters
+	// report, if not nil, lists the emails that were skipped or failed
+	report *runReport
+	// threads, if not nil, holds the thread of every email
+	threads threadIndex
+	// resolver, if not nil, looks up the threads of the emails in the index, for the runs that do not read every email
+	resolver *threadResolver
+	// documents, if not nil, collects the ids of the indexed emails
+	documents *documentIDs
+	// stats counts the indexed, rejected and skipped emails
+	stats runStats
+	opts  Options
+}
+
+// run parses and uploads the batches produced by the source using a pool of parsers feeding a bounded
+// queue that is drained by a pool of uploaders. Batches are not uploaded in any particular order.
+// The first error cancels every stage and is returned once all goroutines have stopped.
+func (p *pipeline) run(ctx context.Context) error {
+	opts := p.opts
+	if opts.Oversized != OversizedTruncate && opts.Oversized != OversizedReject {
+		opts.Oversized = OversizedTruncate
+	}
+	if opts.Parsers < 1 {
+		opts.Parsers = 1
+	}
+	if opts.Uploaders < 1 {
+		opts.Uploaders = 1
+	}
+	if opts.QueueSize < 0 {
+		opts.QueueSize = 0
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	jobs := make(chan batch)
+	parsed := make(chan parsedBatch, opts.QueueSize)
+	progress := newProgress(p.totalBatches)
+
+	g.Go(func() error {
+		defer close(jobs)
+		return p.source(ctx, jobs)
+	})
+
+	var parsers sync.WaitGroup
+	for i := 0; i < opts.Parsers; i++ {
+		parsers.Add(1)
+		g.Go(func() error {
+			defer parsers.Done()
+			for b := range jobs {
+				if p.checkpoint != nil && p.checkpoint.acknowledged(b) {
+					log.Printf("Skipping batch %d, already acknowledged", b.seq+1)
+					progress.batchSkipped()
+					continue
+				}
+				messages := parseBatch(b, p.opts.Lenient, p.report)
+				for _, email := range messages {
+					setMailboxFields(email, p.root)
+					p.threads.set(email)
+					p.resolveThread(ctx, email)
+				}
+				p.stats.addSkipped(len(b.paths) - len(messages))
+				select {
+				case parsed <- parsedBatch{batch: b, messages: messages}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	}
+	go func() {
+		parsers.Wait()
+		close(parsed)
+	}()
+
+	for i := 0; i < opts.Uploaders; i++ {
+		g.Go(func() error {
+			for parsed := range parsed {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := p.upload(ctx, parsed); err != nil {
+					return err
+				}
+				progress.batchDone()
+			}
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// resolveThread looks up the thread of the email in the index. An email whose thread cannot be found is
+// indexed without one.
+func (p *pipeline) resolveThread(ctx context.Context, email *EmailJson) {
+	if err := p.resolver.resolve(ctx, email); err != nil {
+		log.Printf("Error finding the thread of %s: %v", email.SourcePath, err)
+	}
+}
+
+// upload writes a parsed batch to the sink and records it as acknowledged. When a batch holds modified
+// files and the sink can delete documents, the ones indexed from their previous version are deleted first.
+func (p *pipeline) upload(ctx context.Context, parsed parsedBatch) error {
+	if deleter, ok := p.sink.(sourceDeleter); ok && p.manifest != nil {
+		for _, path := range p.manifest.replacedPaths(parsed.batch) {
+			if _, err := deleter.DeleteSource(ctx, path); err != nil {
+				return fmt.Errorf("error deleting old documents of %s: %w", path, err)
+			}
+		}
+	}
+
+	messages := parsed.messages
+	layout := sinkLayout(p.sink, p.opts.Index)
+	if p.opts.BatchBytes > 0 {
+		messages = make([]*EmailJson, 0, len(parsed.messages))
+		for _, email := range parsed.messages {
+			if err := fitDocument(email, layout, p.opts.BatchBytes, p.opts.Oversized); err != nil {
+				log.Printf("Email %s skipped: %v", email.SourcePath, err)
+				p.stats.addSkipped(1)
+				p.report.addEmail(email, ReportOversized, err.Error())
+				if p.deadLetters != nil {
+					if err := p.deadLetters.write(email, err.Error()); err != nil {
+						return fmt.Errorf("error writing dead letter: %w", err)
+					}
+				}
+				continue
+			}
+			if email.Truncated {
+				log.Printf("Email %s truncated to fit in a batch of %d bytes", email.SourcePath, p.opts.BatchBytes)
+			}
+			messages = append(messages, email)
+		}
+	}
+
+	var rejected []rejectedEmail
+	for _, chunk := range splitBySize(messages, layout, p.opts.BatchBytes) {
+		chunkRejected, err := p.uploadRecords(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		rejected = append(rejected, chunkRejected...)
+	}
+	p.stats.addIndexed(len(messages) - len(rejected))
+	refused := make(map[*EmailJson]bool, len(rejected))
+	for _, r := range rejected {
+		refused[r.email] = true
+	}
+	indexed := make([]*EmailJson, 0, len(messages))
+	for _, email := range messages {
+		if !refused[email] {
+			indexed = append(indexed, email)
+		}
+	}
+	p.documents.add(indexed)
+	p.stats.addRejected(len(rejected))
+	for _, r := range rejected {
+		log.Printf("Email %s rejected by the server: %s", r.email.SourcePath, r.reason)
+		p.report.addEmail(r.email, ReportRejected, r.reason)
+		if p.deadLetters == nil {
+			continue
+		}
+		if err := p.deadLetters.write(r.email, r.reason); err != nil {
+			return fmt.Errorf("error writing dead letter: %w", err)
+		}
+	}
+
+	if p.checkpoint != nil {
+		if err := p.checkpoint.acknowledge(parsed.batch); err != nil {
+			return fmt.Errorf("error saving checkpoint: %w", err)
+		}
+	}
+	if p.manifest != nil {
+		// The skipped, oversized and rejected emails stay pending, so the next incremental run tries them again
+		p.manifest.acknowledge(indexed)
+	}
+	return nil
+}
+
+// rejectedEmail is an email the server refused to index
+type rejectedEmail struct {
+	email  *EmailJson
+	reason string
+}
+
+// uploadRecords writes the emails to the sink and sends the records rejected by the server again, up to
+// RecordRetries times. It returns the emails that were still rejected after the last attempt.
+func (p *pipeline) uploadRecords(ctx context.Context, emails []*EmailJson) ([]rejectedEmail, error) {
+	pending := emails
+	for attempt := 0; ; attempt++ {
+		var failed []recordError
+		err := p.opts.Retry.do(ctx, "upload batch", func() error {
+			var err error
+			failed, err = p.sink.Write(ctx, pending)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(failed) == 0 {
+			return nil, nil
+		}
+
+		if attempt >= p.opts.RecordRetries {
+			rejected := make([]rejectedEmail, 0, len(failed))
+			for _, f := range failed {
+				rejected = append(rejected, rejectedEmail{email: pending[f.Index], reason: f.Error})
+			}
+			return rejected, nil
+		}
+
+		log.Printf("Server rejected %d of %d records, sending them again", len(failed), len(pending))
+		retry := make([]*EmailJson, 0, len(failed))
+		for _, f := range failed {
+			retry = append(retry, pending[f.Index])
+		}
+		pending = retry
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// writeTestEmails creates n simple email files in dir and returns their paths
+func writeTestEmails(t *testing.T, dir string, n int) []string {
+	paths := make([]string, n)
+	for i := 0; i < n; i++ {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("email%d.txt", i))
+		content := fmt.Sprintf("From: test@example.com\nSubject: Test Email %d\n\ntest email %d", i, i)
+		if err := ioutil.WriteFile(paths[i], []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+// sliceSource returns a batch source that sends the given batches in order
+func sliceSource(batches [][]string) batchSource {
+	return func(ctx context.Context, out chan<- batch) error {
+		for i, paths := range batches {
+			select {
+			case out <- batch{seq: i, paths: paths}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+}
+
+func TestPipelineRun(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	writeTestEmails(t, tempDir, 10)
+
+	// Count the records received by a fake server
+	var mu sync.Mutex
+	received := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Records []*EmailJson `json:"records"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		received += len(payload.Records)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	opts := Options{Parsers: 3, Uploaders: 2, QueueSize: 1}
+	if err := (&pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), source: maildirSource(tempDir, FormatMaildir, 3, nil), totalBatches: 4, opts: opts}).run(context.Background()); err != nil {
+		t.Errorf("pipeline.run returned an error: %v", err)
+	}
+	if received != 10 {
+		t.Errorf("pipeline.run did not upload every email. Got: %d, expected: 10", received)
+	}
+}
+
+func TestPipelineRunUploadError(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	writeTestEmails(t, tempDir, 20)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	// The first failed upload must stop the pipeline and be returned
+	p := &pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), source: maildirSource(tempDir, FormatMaildir, 1, nil), totalBatches: 20, opts: Options{Parsers: 4, Uploaders: 2, QueueSize: 1}}
+	err := p.run(context.Background())
+	if err == nil {
+		t.Error("pipeline.run did not return an error when the server rejected a batch")
+	}
+}
+
+func TestPipelineRunParseError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	// A missing file is skipped like an email with malformed headers, so the run goes on
+	batches := [][]string{{"/invalid/file"}}
+	p := &pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), source: sliceSource(batches), totalBatches: 1, opts: DefaultOptions()}
+	if err := p.run(context.Background()); err != nil {
+		t.Errorf("pipeline.run returned an error for a missing email file: %v", err)
+	}
+	if p.stats.Skipped != 1 {
+		t.Errorf("pipeline.run did not skip the missing email file. Got: %d skipped, expected: 1", p.stats.Skipped)
+	}
+}
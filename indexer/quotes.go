@@ -0,0 +1,161 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ForwardedMessage is a message forwarded inside the body of an email, with the headers written above it
+type ForwardedMessage struct {
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Cc      string `json:"cc,omitempty"`
+	Date    string `json:"date,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body,omitempty"`
+}
+
+var (
+	// originalMarker starts a quoted reply, as in "-----Original Message-----"
+	originalMarker = regexp.MustCompile(`(?i)^\s*-{2,}\s*original message\s*-{2,}\s*$`)
+	// wroteMarker starts a quoted reply, as in "On Mon, May 14, 2001, Phillip Allen wrote:"
+	wroteMarker = regexp.MustCompile(`(?i)^\s*on\s.+\swrote:\s*$`)
+	// forwardMarker starts a forwarded message, as in "---------------------- Forwarded by Phillip K Allen/HOU/ECT on
+	// 10/16/2000 01:42 PM ---------------------------", "---------- Forwarded message ----------" or "Begin forwarded message:"
+	forwardMarker = regexp.MustCompile(`(?i)^\s*(-{2,}\s*forwarded (by\s.*|message\s*-{2,})|begin forwarded message:)\s*$`)
+	// notesSender is the sender line Lotus Notes writes above a forwarded message, as in
+	// "Buck Buckner <buck.buckner@honeywell.com> on 10/12/2000 01:12:21 PM"
+	notesSender = regexp.MustCompile(`(?i)^\s*(.*\S)\s+on\s+(\d{1,2}/\d{1,2}/\d{2,4}\s+\d{1,2}:\d{2}(:\d{2})?\s*[ap]m)\s*$`)
+	// embeddedHeader is a header line of a forwarded message
+	embeddedHeader = regexp.MustCompile(`(?i)^\s*(from|to|cc|date|sent|subject)\s*:\s*(.*)$`)
+)
+
+// signatureDelimiter is the line that starts a signature, "-- " by convention; some clients drop the space
+const signatureDelimiter = "--"
+
+// maxSignatureLines is the longest signature; longer text after a delimiter is taken as part of the message
+const maxSignatureLines = 10
+
+// bodyParts is the body of an email split by who wrote each part
+type bodyParts struct {
+	// new is the text written by the author of the email
+	new string
+	// quoted holds the replied-to messages and the lines quoted with ">"
+	quoted string
+	// signature is the text after the signature delimiter of the author's text
+	signature string
+	// forwarded are the messages forwarded in the body
+	forwarded []ForwardedMessage
+}
+
+// splitBody separates the author's text of a body from the quoted replies, the signature and the forwarded messages.
+// Everything after the first reply or forward marker belongs to older messages. A forwarded message lasts until the
+// next marker, so the reply chain quoted inside it is kept apart from its own text.
+func splitBody(body string) bodyParts {
+	var parts bodyParts
+	var newLines, quoted, forwarded []string
+	inForward, inQuote := false, false
+	endForward := func() {
+		if inForward {
+			parts.forwarded = append(parts.forwarded, parseForwarded(forwarded))
+		}
+		inForward, forwarded = false, nil
+	}
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case forwardMarker.MatchString(line):
+			endForward()
+			inForward, inQuote = true, false
+		case originalMarker.MatchString(line) || wroteMarker.MatchString(line):
+			endForward()
+			inQuote = true
+			quoted = append(quoted, line)
+		case inForward:
+			forwarded = append(forwarded, line)
+		case inQuote || strings.HasPrefix(line, ">"):
+			quoted = append(quoted, line)
+		default:
+			newLines = append(newLines, line)
+		}
+	}
+	endForward()
+
+	// The signature is only looked for in the author's text, so a delimiter in a quoted message is ignored
+	for i := len(newLines) - 1; i >= 0 && len(newLines)-i <= maxSignatureLines+1; i-- {
+		if strings.TrimRight(newLines[i], " ") == signatureDelimiter {
+			parts.signature = strings.TrimSpace(strings.Join(newLines[i+1:], "\n"))
+			newLines = newLines[:i]
+			break
+		}
+	}
+	parts.new = strings.TrimSpace(strings.Join(newLines, "\n"))
+	parts.quoted = strings.TrimSpace(strings.Join(quoted, "\n"))
+	return parts
+}
+
+// parseForwarded reads the headers at the top of a forwarded message, up to the first blank line, and the body
+// that follows. A block without any known header is taken as the body.
+func parseForwarded(lines []string) ForwardedMessage {
+	var message ForwardedMessage
+	start := 0
+	for start < len(lines) && strings.TrimSpace(lines[start]) == "" {
+		start++
+	}
+
+	// field is the header the previous line set, so the lines that continue it, as the long To lists Notes wraps
+	// without indentation, are appended
+	var field *string
+	found := false
+	end := start
+	for ; end < len(lines) && strings.TrimSpace(lines[end]) != ""; end++ {
+		line := lines[end]
+		if match := embeddedHeader.FindStringSubmatch(line); match != nil {
+			field = message.field(match[1])
+			*field = strings.TrimSpace(match[2])
+			found = true
+			continue
+		}
+		if match := notesSender.FindStringSubmatch(line); match != nil && end == start {
+			message.From, message.Date = match[1], match[2]
+			field = nil
+			found = true
+			continue
+		}
+		if field == nil {
+			break
+		}
+		*field = strings.TrimSpace(*field + " " + strings.TrimSpace(line))
+	}
+	if !found {
+		message = ForwardedMessage{}
+		end = start
+	}
+	message.Body = strings.TrimSpace(strings.Join(lines[end:], "\n"))
+	return message
+}
+
+// field returns the field of an embedded header; Sent is how Outlook writes the date
+func (m *ForwardedMessage) field(name string) *string {
+	switch strings.ToLower(name) {
+	case "from":
+		return &m.From
+	case "to":
+		return &m.To
+	case "cc":
+		return &m.Cc
+	case "subject":
+		return &m.Subject
+	}
+	return &m.Date
+}
+
+// setBodyParts fills the fields of the email that split its body by author
+func setBodyParts(email *EmailJson) {
+	parts := splitBody(email.Body)
+	email.BodyNew = parts.new
+	email.BodyQuoted = parts.quoted
+	email.Signature = parts.signature
+	email.Forwarded = parts.forwarded
+}
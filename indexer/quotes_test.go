@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitBodyReply(t *testing.T) {
+	body := "Sounds good, see you there.\r\n" +
+		"> Can we meet at 3?\r\n" +
+		"\r\n" +
+		"-- \r\n" +
+		"Phillip Allen\r\n" +
+		"Enron North America\r\n" +
+		"\r\n" +
+		" -----Original Message-----\r\n" +
+		"From: \tGrigsby, Mike  \r\n" +
+		"Sent:\tMonday, May 14, 2001 9:42 AM\r\n" +
+		"Subject:\tMeeting\r\n" +
+		"\r\n" +
+		"Let's meet tomorrow.\r\n" +
+		"--\r\n" +
+		"Mike\r\n"
+
+	parts := splitBody(body)
+	if parts.new != "Sounds good, see you there." {
+		t.Errorf("splitBody did not keep the author's text. Got: %q", parts.new)
+	}
+	if parts.signature != "Phillip Allen\nEnron North America" {
+		t.Errorf("splitBody did not separate the signature. Got: %q", parts.signature)
+	}
+	expectedQuoted := "> Can we meet at 3?\n -----Original Message-----\nFrom: \tGrigsby, Mike  \nSent:\tMonday, May 14, 2001 9:42 AM\n" +
+		"Subject:\tMeeting\n\nLet's meet tomorrow.\n--\nMike"
+	if parts.quoted != expectedQuoted {
+		t.Errorf("splitBody did not separate the quoted reply. Got: %q, expected: %q", parts.quoted, expectedQuoted)
+	}
+	if parts.forwarded != nil {
+		t.Errorf("splitBody found a forwarded message in a reply. Got: %+v", parts.forwarded)
+	}
+}
+
+func TestSplitBodyForwarded(t *testing.T) {
+	body := "FYI, see below.\n" +
+		"---------------------- Forwarded by Phillip K Allen/HOU/ECT on 10/16/2000 01:42 PM ---------------------------\n" +
+		"\n" +
+		"\n" +
+		"\"Buckner, Buck\" <buck.buckner@honeywell.com> on 10/12/2000 01:12:21 PM\n" +
+		"To: \"'Pallen@Enron.com'\" <Pallen@Enron.com>, Mike Grigsby/HOU/ECT@ECT, Keith\n" +
+		"Holst/HOU/ECT@ECT\n" +
+		"cc:  \n" +
+		"Subject: FW: fixed forward or other Collar floor gas price terms\n" +
+		"\n" +
+		"Phillip,\n" +
+		"\n" +
+		"Please review the attached terms.\n" +
+		"\n" +
+		"-----Original Message-----\n" +
+		"From: Someone Else\n" +
+		"\n" +
+		"Older text\n" +
+		"---------- Forwarded message ----------\n" +
+		"Plain forwarded text without headers\n"
+
+	parts := splitBody(body)
+	if parts.new != "FYI, see below." {
+		t.Errorf("splitBody did not keep the author's text. Got: %q", parts.new)
+	}
+	expected := []ForwardedMessage{
+		{
+			From:    "\"Buckner, Buck\" <buck.buckner@honeywell.com>",
+			Date:    "10/12/2000 01:12:21 PM",
+			To:      "\"'Pallen@Enron.com'\" <Pallen@Enron.com>, Mike Grigsby/HOU/ECT@ECT, Keith Holst/HOU/ECT@ECT",
+			Subject: "FW: fixed forward or other Collar floor gas price terms",
+			Body:    "Phillip,\n\nPlease review the attached terms.",
+		},
+		{Body: "Plain forwarded text without headers"},
+	}
+	if !reflect.DeepEqual(parts.forwarded, expected) {
+		t.Errorf("splitBody did not extract the forwarded messages. Got: %+v, expected: %+v", parts.forwarded, expected)
+	}
+	if parts.quoted != "-----Original Message-----\nFrom: Someone Else\n\nOlder text" {
+		t.Errorf("splitBody did not keep the reply chain of the forwarded message apart. Got: %q", parts.quoted)
+	}
+}
+
+func TestSplitBodyPlain(t *testing.T) {
+	body := "Prices are up.\n--\nsection break that is too long to be a signature\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	parts := splitBody(body)
+	if parts.new != "Prices are up.\n--\nsection break that is too long to be a signature\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10" || parts.signature != "" {
+		t.Errorf("splitBody did not keep a long text after a delimiter. Got: %q, signature: %q", parts.new, parts.signature)
+	}
+	if parts.quoted != "" || parts.forwarded != nil {
+		t.Errorf("splitBody found older messages in a plain body. Got: %q, %+v", parts.quoted, parts.forwarded)
+	}
+}
+
+func TestParseMessageBodyParts(t *testing.T) {
+	raw := []byte("Subject: RE: Budget\n\nApproved.\n\n-----Original Message-----\nFrom: Mike\n\nPlease approve the budget.\n")
+	email, err := parseMessage(raw, "1.", nil, false)
+	if err != nil {
+		t.Fatalf("parseMessage returned an error: %v", err)
+	}
+	if email.BodyNew != "Approved." || email.BodyQuoted == "" || email.Body != string(raw[21:]) {
+		t.Errorf("parseMessage did not split the body. Got new: %q, quoted: %q, body: %q", email.BodyNew, email.BodyQuoted, email.Body)
+	}
+}
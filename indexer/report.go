@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Categories of the emails listed in a run report
+const (
+	// ReportMalformedHeader is an email skipped because its headers could not be parsed
+	ReportMalformedHeader = "malformed_header"
+	// ReportIOError is an email that could not be read
+	ReportIOError = "io_error"
+	// ReportOversized is an email left out because it does not fit in a batch
+	ReportOversized = "oversized"
+	// ReportRejected is an email the server refused to index
+	ReportRejected = "rejected"
+)
+
+// reportEntry is an email that was skipped or failed during a run
+type reportEntry struct {
+	Path     string `json:"path"`
+	Offset   *int64 `json:"offset,omitempty"`
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// runReport collects the emails that were skipped or failed during a run, so they can be audited and
+// indexed again. Its methods do nothing on a nil report.
+type runReport struct {
+	mu      sync.Mutex
+	entries []reportEntry
+}
+
+// add records a skipped or failed email
+func (r *runReport) add(path string, offset *int64, category, message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, reportEntry{Path: path, Offset: offset, Category: category, Message: message})
+}
+
+// addEmail records a parsed email that was skipped or failed
+func (r *runReport) addEmail(email *EmailJson, category, message string) {
+	r.add(email.SourcePath, email.SourceOffset, category, message)
+}
+
+// totals returns the number of emails of every category
+func (r *runReport) totals() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	totals := map[string]int{}
+	for _, entry := range r.entries {
+		totals[entry.Category]++
+	}
+	return totals
+}
+
+// sorted returns the entries ordered by path and offset, since emails are processed in no particular order
+func (r *runReport) sorted() []reportEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := append([]reportEntry{}, r.entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Path != entries[j].Path {
+			return entries[i].Path < entries[j].Path
+		}
+		return entries[i].Offset != nil && entries[j].Offset != nil && *entries[i].Offset < *entries[j].Offset
+	})
+	return entries
+}
+
+// encodeJSON returns the report as a JSON object with the totals per category and the entries
+func (r *runReport) encodeJSON() ([]byte, error) {
+	return json.MarshalIndent(struct {
+		Totals  map[string]int `json:"totals"`
+		Entries []reportEntry  `json:"entries"`
+	}{r.totals(), r.sorted()}, "", "  ")
+}
+
+// encodeCSV returns the report as CSV with a path, offset, category and message column. The entries are
+// followed by a row per category, without path or offset, whose message is the number of emails of the category.
+func (r *runReport) encodeCSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"path", "offset", "category", "message"})
+	for _, entry := range r.sorted() {
+		offset := ""
+		if entry.Offset != nil {
+			offset = strconv.FormatInt(*entry.Offset, 10)
+		}
+		w.Write([]string{entry.Path, offset, entry.Category, entry.Message})
+	}
+	totals := r.totals()
+	categories := make([]string, 0, len(totals))
+	for category := range totals {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		w.Write([]string{"", "", category, strconv.Itoa(totals[category])})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// write saves the report to path, as CSV if it ends in .csv and as JSON otherwise
+func (r *runReport) write(path string) error {
+	encode := r.encodeJSON
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		encode = r.encodeCSV
+	}
+	data, err := encode()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
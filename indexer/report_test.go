@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunReportWrite(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "report")
+	defer os.RemoveAll(tempDir)
+
+	report := &runReport{}
+	offset := int64(120)
+	report.add("b.txt", nil, ReportRejected, "mapper_parsing_exception")
+	report.add("a.mbox", &offset, ReportMalformedHeader, "malformed headers")
+	report.add("c.txt", nil, ReportRejected, "bad date")
+
+	jsonPath := filepath.Join(tempDir, "report.json")
+	if err := report.write(jsonPath); err != nil {
+		t.Fatalf("write returned an error: %v", err)
+	}
+	data, _ := ioutil.ReadFile(jsonPath)
+	var decoded struct {
+		Totals  map[string]int `json:"totals"`
+		Entries []reportEntry  `json:"entries"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("the JSON report is invalid: %v", err)
+	}
+	if decoded.Totals[ReportRejected] != 2 || decoded.Totals[ReportMalformedHeader] != 1 {
+		t.Errorf("the JSON report does not hold the totals. Got: %v", decoded.Totals)
+	}
+	if len(decoded.Entries) != 3 || decoded.Entries[0].Path != "a.mbox" || *decoded.Entries[0].Offset != 120 {
+		t.Errorf("the JSON report does not list the entries in order. Got: %+v", decoded.Entries)
+	}
+
+	csvPath := filepath.Join(tempDir, "report.csv")
+	if err := report.write(csvPath); err != nil {
+		t.Fatalf("write returned an error: %v", err)
+	}
+	file, _ := os.Open(csvPath)
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("the CSV report is invalid: %v", err)
+	}
+	expected := [][]string{
+		{"path", "offset", "category", "message"},
+		{"a.mbox", "120", ReportMalformedHeader, "malformed headers"},
+		{"b.txt", "", ReportRejected, "mapper_parsing_exception"},
+		{"c.txt", "", ReportRejected, "bad date"},
+		{"", "", ReportMalformedHeader, "1"},
+		{"", "", ReportRejected, "2"},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("the CSV report has unexpected rows. Got: %q", rows)
+	}
+	for i := range expected {
+		if strings.Join(rows[i], ",") != strings.Join(expected[i], ",") {
+			t.Errorf("the CSV report has an unexpected row %d. Got: %q, expected: %q", i, rows[i], expected[i])
+		}
+	}
+}
+
+func TestPipelineRunReport(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	writeTestEmails(t, tempDir, 3)
+	ioutil.WriteFile(filepath.Join(tempDir, "malformed.txt"), []byte("From test@example.com\n\nbody"), 0644)
+	ioutil.WriteFile(filepath.Join(tempDir, "oversized.txt"), []byte("Subject: big\n\n"+strings.Repeat("x", 4096)), 0644)
+
+	ts := rejectingServer(map[string]int{"email2.txt": 10})
+	defer ts.Close()
+
+	report := &runReport{}
+	opts := Options{BatchBytes: 2048, Oversized: OversizedReject}
+	p := &pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), source: maildirSource(tempDir, FormatMaildir, 10, nil), report: report, opts: opts}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatalf("pipeline.run returned an error: %v", err)
+	}
+
+	totals := report.totals()
+	if totals[ReportMalformedHeader] != 1 || totals[ReportOversized] != 1 || totals[ReportRejected] != 1 {
+		t.Errorf("pipeline.run did not report the skipped and rejected emails. Got: %v", totals)
+	}
+	for _, entry := range report.sorted() {
+		if entry.Category == ReportRejected && filepath.Base(entry.Path) != "email2.txt" {
+			t.Errorf("pipeline.run reported the wrong rejected email. Got: %+v", entry)
+		}
+	}
+}
+
+func TestPipelineRunReportIOError(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	paths := writeTestEmails(t, tempDir, 2)
+
+	report := &runReport{}
+	sink := &recordingSink{}
+	batches := [][]string{{"/nonexistent/email1.txt", paths[0]}, {"/nonexistent/email2.txt", paths[1]}}
+	p := &pipeline{sink: sink, source: sliceSource(batches), report: report, opts: DefaultOptions()}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatalf("pipeline.run stopped at a missing email file: %v", err)
+	}
+	if totals := report.totals(); totals[ReportIOError] != 2 {
+		t.Errorf("pipeline.run did not report every unreadable email. Got: %v", totals)
+	}
+	if len(sink.written) != 2 || p.stats.Skipped != 2 {
+		t.Errorf("pipeline.run did not index the readable emails and skip the others. Got: %d written, %d skipped", len(sink.written), p.stats.Skipped)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statusError is returned when the server answers with an unexpected status code
+type statusError struct {
+	StatusCode int
+	// RetryAfter is the delay requested by the server in the Retry-After header, or zero
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// newStatusError returns the error for an unexpected response, keeping its Retry-After delay
+func newStatusError(resp *http.Response) *statusError {
+	return &statusError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// isRetryable reports whether a failed request may succeed if it is sent again: network errors,
+// 429 Too Many Requests and 5xx responses. Other 4xx responses, cancellations and every other error,
+// such as an invalid bulk response or a failed write of the file sink, are final.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.StatusCode == http.StatusTooManyRequests || status.StatusCode >= 500
+	}
+	// The HTTP client returns a *url.Error when a request fails and reading the body fails with a
+	// *net.OpError or io.ErrUnexpectedEOF when the connection is lost. net.Error is not checked, since
+	// syscall.Errno implements it and a failed write of a file would be retried.
+	var urlErr *url.Error
+	var opErr *net.OpError
+	return errors.As(err, &urlErr) || errors.As(err, &opErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryPolicy controls how failed uploads are retried
+type retryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one
+	MaxAttempts int
+	// BaseDelay is the delay cap before the second attempt; it doubles with every attempt
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts
+	MaxDelay time.Duration
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns the delay before the given retry (starting at 1), using exponential backoff with full jitter
+func (r retryPolicy) backoff(retry int) time.Duration {
+	limit := r.BaseDelay
+	for i := 1; i < retry && limit < r.MaxDelay; i++ {
+		limit *= 2
+	}
+	if r.MaxDelay > 0 && limit > r.MaxDelay {
+		limit = r.MaxDelay
+	}
+	if limit <= 0 {
+		return 0
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(limit) + 1))
+}
+
+// do calls fn until it succeeds, returns an error that is not retryable or the attempts run out.
+// The server's Retry-After delay is used instead of the backoff when present.
+func (r retryPolicy) do(ctx context.Context, what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		if attempt >= r.MaxAttempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", what, attempt, err)
+		}
+
+		delay := r.backoff(attempt)
+		var status *statusError
+		if errors.As(err, &status) && status.RetryAfter > 0 {
+			delay = status.RetryAfter
+		}
+		log.Printf("Attempt %d of %d to %s failed: %v. Retrying in %v", attempt, r.MaxAttempts, what, err, delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
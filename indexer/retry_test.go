@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&url.Error{Op: "Post", URL: "http://localhost:4080/api/_bulkv2", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}, true},
+		{fmt.Errorf("error decoding bulk response: %w", io.ErrUnexpectedEOF), true},
+		{fmt.Errorf("error decoding bulk response: %w", errors.New("invalid character '<'")), false},
+		{errors.New("server indexed 2 of 3 records"), false},
+		{&fs.PathError{Op: "write", Path: "emails.ndjson", Err: syscall.ENOSPC}, false},
+		{&statusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&statusError{StatusCode: http.StatusBadGateway}, true},
+		{&statusError{StatusCode: http.StatusBadRequest}, false},
+		{&statusError{StatusCode: http.StatusUnauthorized}, false},
+		{context.Canceled, false},
+	}
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.retryable {
+			t.Errorf("isRetryable(%v) = %v, expected: %v", test.err, got, test.retryable)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry := 1; retry <= 8; retry++ {
+		limit := policy.BaseDelay << uint(retry-1)
+		if limit > policy.MaxDelay {
+			limit = policy.MaxDelay
+		}
+		if delay := policy.backoff(retry); delay < 0 || delay > limit {
+			t.Errorf("backoff(%d) = %v, expected a delay between 0 and %v", retry, delay, limit)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("3"); got != 3*time.Second {
+		t.Errorf("parseRetryAfter did not parse seconds. Got: %v", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got <= 0 || got > time.Minute {
+		t.Errorf("parseRetryAfter did not parse an HTTP date. Got: %v", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("parseRetryAfter returned a delay for an invalid value. Got: %v", got)
+	}
+}
+
+func TestUploadBatchRetry(t *testing.T) {
+	// Fail twice with retryable responses, the second one asking to wait a second
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer ts.Close()
+
+	p := &pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), opts: Options{Retry: retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}}
+	start := time.Now()
+	if _, err := p.uploadRecords(context.Background(), []*EmailJson{{Body: "test"}}); err != nil {
+		t.Fatalf("uploadRecords returned an error: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("uploadRecords did not retry the failed uploads. Got: %d requests, expected: 3", requests)
+	}
+	if time.Since(start) < time.Second {
+		t.Errorf("uploadRecords did not honor the Retry-After header")
+	}
+}
+
+func TestUploadBatchNoRetry(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	// Client errors are not retried
+	p := &pipeline{sink: newZincSink(ts.URL, INDEX, credentials{}, false), opts: Options{Retry: retryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond}}}
+	if _, err := p.uploadRecords(context.Background(), []*EmailJson{{Body: "test"}}); err == nil {
+		t.Errorf("uploadRecords did not return an error for a 400 response")
+	}
+	if requests != 1 {
+		t.Errorf("uploadRecords retried a 400 response. Got: %d requests, expected: 1", requests)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// SinkZinc sends batches to the Zinc _bulkv2 endpoint
+	SinkZinc = "zinc"
+	// SinkElasticsearch sends batches to an Elasticsearch or OpenSearch compatible _bulk endpoint
+	SinkElasticsearch = "elasticsearch"
+	// SinkFile writes the documents to a local NDJSON file
+	SinkFile = "file"
+	// SinkStdout writes the documents to the standard output as NDJSON
+	SinkStdout = "stdout"
+)
+
+// Sink receives the parsed emails of each batch
+type Sink interface {
+	// Write stores a batch of emails and returns the ones that were rejected, by position in the batch
+	Write(ctx context.Context, emails []*EmailJson) ([]recordError, error)
+	// Close flushes and releases the sink
+	Close() error
+}
+
+// sourceDeleter is implemented by the sinks that can delete the documents parsed from a file,
+// which incremental runs need for modified and deleted files
+type sourceDeleter interface {
+	DeleteSource(ctx context.Context, path string) (int, error)
+}
+
+// indexManager is implemented by the sinks whose index mapping is managed by the indexer
+type indexManager interface {
+	EnsureIndex(ctx context.Context, recreate bool) error
+}
+
+// zincSink sends batches to the Zinc _bulkv2 endpoint
+type zincSink struct {
+	// url is the base URL of the Zinc API, e.g. http://localhost:4080/api
+	url   string
+	index string
+	auth  credentials
+	gzip  bool
+}
+
+// newZincSink returns a sink for the index of the Zinc API at url
+func newZincSink(url, index string, auth credentials, gzip bool) *zincSink {
+	return &zincSink{url: strings.TrimSuffix(url, "/"), index: index, auth: auth, gzip: gzip}
+}
+
+func (s *zincSink) Write(ctx context.Context, emails []*EmailJson) ([]recordError, error) {
+	return uploadBatch(ctx, s.url+"/_bulkv2", s.index, s.auth, emails, s.gzip)
+}
+
+func (s *zincSink) DeleteSource(ctx context.Context, path string) (int, error) {
+	return deleteBySourcePath(ctx, s.url, s.index, s.auth, path)
+}
+
+func (s *zincSink) EnsureIndex(ctx context.Context, recreate bool) error {
+	return ensureIndex(ctx, s.url, s.index, s.auth, recreate)
+}
+
+func (s *zincSink) Close() error {
+	return nil
+}
+
+// elasticsearchSink sends batches as NDJSON to an Elasticsearch or OpenSearch compatible _bulk endpoint
+type elasticsearchSink struct {
+	// url is the base URL of the cluster, e.g. http://localhost:9200
+	url   string
+	index string
+	auth  credentials
+}
+
+// newElasticsearchSink returns a sink for the index of the cluster at url
+func newElasticsearchSink(url, index string, auth credentials) *elasticsearchSink {
+	return &elasticsearchSink{url: strings.TrimSuffix(url, "/"), index: index, auth: auth}
+}
+
+// bulkAction is the action line that precedes every document of an Elasticsearch bulk request
+type bulkAction struct {
+	Index struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id,omitempty"`
+	} `json:"index"`
+}
+
+// bulkLines returns the action line and the document of an email in an Elasticsearch bulk request. The id is
+// sent in the action line only, since Elasticsearch refuses _id inside the document.
+func bulkLines(index string, email *EmailJson) (bulkAction, *EmailJson) {
+	var action bulkAction
+	action.Index.Index = index
+	action.Index.ID = email.ID
+	document := *email
+	document.ID = ""
+	return action, &document
+}
+
+// encodeBulkNDJSON writes an action line and a document line for every email
+func encodeBulkNDJSON(w io.Writer, index string, emails []*EmailJson) error {
+	encoder := json.NewEncoder(w)
+	for _, email := range emails {
+		action, document := bulkLines(index, email)
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+		if err := encoder.Encode(document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PayloadLayout sizes the NDJSON bulk request, where every email is an action line and a document line
+func (s *elasticsearchSink) PayloadLayout() payloadLayout {
+	return payloadLayout{record: func(email *EmailJson) int {
+		action, document := bulkLines(s.index, email)
+		// encodedSize leaves out the newline that ends every line
+		return encodedSize(action) + encodedSize(document) + 2
+	}}
+}
+
+func (s *elasticsearchSink) Write(ctx context.Context, emails []*EmailJson) ([]recordError, error) {
+	var body bytes.Buffer
+	if err := encodeBulkNDJSON(&body, s.index, emails); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url+"/_bulk", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	s.auth.setAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	return parseBulkResponse(resp.Body, len(emails))
+}
+
+func (s *elasticsearchSink) Close() error {
+	return nil
+}
+
+// ndjsonSink writes every email as a line of JSON, to a file or the standard output
+type ndjsonSink struct {
+	mu     sync.Mutex
+	writer *bufio.Writer
+	closer io.Closer
+}
+
+// newFileSink returns a sink that writes to the NDJSON file at path, replacing it
+func newFileSink(path string) (*ndjsonSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonSink{writer: bufio.NewWriter(file), closer: file}, nil
+}
+
+// newStdoutSink returns a sink that writes NDJSON to the standard output
+func newStdoutSink() *ndjsonSink {
+	return &ndjsonSink{writer: bufio.NewWriter(os.Stdout)}
+}
+
+func (s *ndjsonSink) Write(ctx context.Context, emails []*EmailJson) ([]recordError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoder := json.NewEncoder(s.writer)
+	for _, email := range emails {
+		if err := encoder.Encode(email); err != nil {
+			return nil, err
+		}
+	}
+	return nil, s.writer.Flush()
+}
+
+func (s *ndjsonSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// newSink returns the sink selected by the options
+func newSink(opts Options) (Sink, error) {
+	switch opts.Sink {
+	case SinkZinc, "":
+		auth, err := opts.credentials()
+		if err != nil {
+			return nil, err
+		}
+		if auth.Password == "" {
+			return nil, fmt.Errorf("no password for Zinc user %s, set -password-file, %s or password in the config file", auth.Username, envName("password"))
+		}
+		return newZincSink(opts.ZincURL, opts.Index, auth, opts.Gzip), nil
+	case SinkElasticsearch:
+		auth, err := opts.credentials()
+		if err != nil {
+			return nil, err
+		}
+		if auth.Password == "" {
+			// Clusters without security enabled accept anonymous requests
+			auth = credentials{}
+		}
+		return newElasticsearchSink(opts.SinkURL, opts.Index, auth), nil
+	case SinkFile:
+		if opts.Output == "" {
+			return nil, fmt.Errorf("the %s sink needs an output path", SinkFile)
+		}
+		log.Printf("Writing documents to %s", opts.Output)
+		return newFileSink(opts.Output)
+	case SinkStdout:
+		return newStdoutSink(), nil
+	default:
+		return nil, fmt.Errorf("unknown sink %q", opts.Sink)
+	}
+}
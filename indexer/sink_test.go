@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBulkNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	emails := []*EmailJson{{ID: "abc", Body: "first"}, {Body: "second"}}
+	if err := encodeBulkNDJSON(&buf, "email", emails); err != nil {
+		t.Fatalf("encodeBulkNDJSON returned an error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("encodeBulkNDJSON did not write an action and a document per email. Got: %q", lines)
+	}
+	if lines[0] != `{"index":{"_index":"email","_id":"abc"}}` || lines[2] != `{"index":{"_index":"email"}}` {
+		t.Errorf("encodeBulkNDJSON wrote unexpected action lines. Got: %s, %s", lines[0], lines[2])
+	}
+	for _, line := range []string{lines[1], lines[3]} {
+		if strings.Contains(line, `"_id"`) {
+			t.Errorf("encodeBulkNDJSON sent the id inside the document. Got: %s", line)
+		}
+	}
+	if !strings.Contains(lines[1], `"body":"first"`) {
+		t.Errorf("encodeBulkNDJSON did not write the document. Got: %s", lines[1])
+	}
+	if emails[0].ID != "abc" {
+		t.Errorf("encodeBulkNDJSON modified the email")
+	}
+}
+
+func TestElasticsearchSinkWrite(t *testing.T) {
+	var path, contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		w.Write([]byte(`{"errors":true,"items":[{"index":{"_id":"a","status":201}},{"index":{"_id":"b","status":400,"error":{"reason":"bad date"}}}]}`))
+	}))
+	defer ts.Close()
+
+	failed, err := newElasticsearchSink(ts.URL, INDEX, credentials{}).Write(context.Background(), []*EmailJson{{ID: "a"}, {ID: "b"}})
+	if err != nil {
+		t.Fatalf("elasticsearchSink.Write returned an error: %v", err)
+	}
+	if path != "/_bulk" || contentType != "application/x-ndjson" {
+		t.Errorf("elasticsearchSink.Write did not send NDJSON to _bulk. Got: %s %s", path, contentType)
+	}
+	if len(failed) != 1 || failed[0].Index != 1 {
+		t.Errorf("elasticsearchSink.Write did not return the rejected record. Got: %v", failed)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "sink")
+	defer os.RemoveAll(tempDir)
+	output := filepath.Join(tempDir, "emails.ndjson")
+
+	sink, err := newSink(Options{Sink: SinkFile, Output: output})
+	if err != nil {
+		t.Fatalf("newSink returned an error: %v", err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if _, err := sink.Write(context.Background(), []*EmailJson{{ID: body, Body: body}}); err != nil {
+			t.Fatalf("fileSink.Write returned an error: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("fileSink.Close returned an error: %v", err)
+	}
+
+	file, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("the output file was not written: %v", err)
+	}
+	defer file.Close()
+	var bodies []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var email EmailJson
+		if err := json.Unmarshal(scanner.Bytes(), &email); err != nil {
+			t.Fatalf("the output file holds an invalid line: %v", err)
+		}
+		bodies = append(bodies, email.Body)
+	}
+	if strings.Join(bodies, ",") != "first,second" {
+		t.Errorf("fileSink did not write every email. Got: %v", bodies)
+	}
+}
+
+func TestNewSinkErrors(t *testing.T) {
+	if _, err := newSink(Options{Sink: SinkFile}); err == nil {
+		t.Errorf("newSink did not return an error for a file sink without output")
+	}
+	if _, err := newSink(Options{Sink: "kafka"}); err == nil {
+		t.Errorf("newSink did not return an error for an unknown sink")
+	}
+}
+
+func TestPipelineRunFileSink(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "maildir")
+	defer os.RemoveAll(tempDir)
+	writeTestEmails(t, tempDir, 3)
+
+	var buf bytes.Buffer
+	sink := &ndjsonSink{writer: bufio.NewWriter(&buf)}
+	p := &pipeline{sink: sink, source: maildirSource(tempDir, FormatMaildir, 2, nil), opts: Options{Parsers: 2, Uploaders: 2}}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatalf("pipeline.run returned an error: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 || p.stats.Indexed != 3 {
+		t.Errorf("pipeline.run did not write every email to the sink. Got: %d lines, %s", lines, &p.stats)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// replyPrefix matches a reply or forward prefix of a subject, as in "RE: ", "Fwd: " or "Re[2]: "
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(re|fwd?)(\[\d+\])?\s*:\s*`)
+
+// messageIDPattern matches the message ids of In-Reply-To and References headers
+var messageIDPattern = regexp.MustCompile(`<[^<>]+>`)
+
+// normalizeSubject strips the reply and forward prefixes of a subject, lowercases it and collapses its spaces.
+// It reports whether a prefix was stripped, which marks the email as part of an earlier conversation.
+func normalizeSubject(subject string) (string, bool) {
+	reply := false
+	for {
+		loc := replyPrefix.FindStringIndex(subject)
+		if loc == nil {
+			break
+		}
+		subject = subject[loc[1]:]
+		reply = true
+	}
+	return strings.ToLower(strings.Join(strings.Fields(subject), " ")), reply
+}
+
+// normalizeMessageID returns a message id without its angle brackets and surrounding spaces
+func normalizeMessageID(id string) string {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">"))
+}
+
+// referencedIDs returns the message ids of a References or In-Reply-To header value. Values without
+// angle brackets, as written by some clients, are taken as a single id.
+func referencedIDs(value string) []string {
+	var ids []string
+	for _, id := range messageIDPattern.FindAllString(value, -1) {
+		if id = normalizeMessageID(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if ids == nil {
+		if id := normalizeMessageID(value); id != "" && !strings.ContainsAny(id, " \t") {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// threadMessage is what thread reconstruction needs to know about an email
+type threadMessage struct {
+	// key is the source name of the email, which identifies it in the thread index
+	key string
+	// docID is the id of the document of the email
+	docID string
+	// messageID is the Message-ID of the email, without angle brackets
+	messageID string
+	// parents are the message ids of the References and In-Reply-To headers
+	parents []string
+	// subject is the normalized subject and reply is set if it had a reply or forward prefix
+	subject string
+	reply   bool
+	// date is zero if the email has no valid Date header
+	date time.Time
+}
+
+// newThreadMessage reads the headers of a raw email. Malformed headers are salvaged, since the email
+// may still be indexed in lenient mode.
+func newThreadMessage(raw []byte, key string) threadMessage {
+	var header mail.Header
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		header = msg.Header
+	} else {
+		header, _, _, _ = salvageHeaders(raw)
+	}
+	m := threadMessage{
+		key:       key,
+		docID:     emailID(header, raw),
+		messageID: normalizeMessageID(header.Get("Message-ID")),
+	}
+	for _, field := range []string{"References", "In-Reply-To"} {
+		for _, value := range header[field] {
+			m.parents = append(m.parents, referencedIDs(value)...)
+		}
+	}
+	m.subject, m.reply = normalizeSubject(decodeHeaderValue(header.Get("Subject")))
+	m.date, _ = parseDate(header.Get("Date"))
+	return m
+}
+
+// threadPosition is the thread of an email and its position in it, starting at 0 for the first email
+type threadPosition struct {
+	id       string
+	position int
+}
+
+// threadIndex maps the source name of every email to its thread
+type threadIndex map[string]threadPosition
+
+// set fills the thread fields of the email. Emails missing from the index, or a nil index, are left unchanged.
+func (t threadIndex) set(email *EmailJson) {
+	thread, ok := t[sourceName(email.SourcePath, email.SourceOffset)]
+	if !ok {
+		return
+	}
+	position := thread.position
+	email.ThreadID = thread.id
+	email.ThreadPosition = &position
+}
+
+// unionFind groups the messages of a thread, identified by source name or by message id
+type unionFind map[string]string
+
+// find returns the representative of the group of node
+func (u unionFind) find(node string) string {
+	parent, ok := u[node]
+	if !ok || parent == node {
+		u[node] = node
+		return node
+	}
+	root := u.find(parent)
+	u[node] = root
+	return root
+}
+
+// union merges the groups of a and b
+func (u unionFind) union(a, b string) {
+	if ra, rb := u.find(a), u.find(b); ra != rb {
+		u[ra] = rb
+	}
+}
+
+// buildThreads groups the messages into threads. Messages are linked to the ids of their References and
+// In-Reply-To headers, even if the referenced email is not in the input, so the replies to a missing email
+// still share a thread. A reply without those headers, as most of the Enron emails, is linked to the latest
+// earlier email with the same normalized subject, if it was sent within window. Every thread is identified by
+// the document id of its first email, and its emails are numbered by date.
+func buildThreads(messages []threadMessage, window time.Duration) threadIndex {
+	sort.SliceStable(messages, func(i, j int) bool {
+		if !messages[i].date.Equal(messages[j].date) {
+			return messages[i].date.Before(messages[j].date)
+		}
+		return messages[i].key < messages[j].key
+	})
+
+	groups := unionFind{}
+	latest := map[string]threadMessage{}
+	for _, m := range messages {
+		node := "key:" + m.key
+		groups.find(node)
+		if m.messageID != "" {
+			groups.union(node, "id:"+m.messageID)
+		}
+		for _, parent := range m.parents {
+			groups.union(node, "id:"+parent)
+		}
+		if m.subject == "" || m.date.IsZero() {
+			continue
+		}
+		if previous, ok := latest[m.subject]; ok && len(m.parents) == 0 && m.reply && m.date.Sub(previous.date) <= window {
+			groups.union(node, "key:"+previous.key)
+		}
+		latest[m.subject] = m
+	}
+
+	// The messages are sorted by date, so the first one of every group starts its thread
+	index := make(threadIndex, len(messages))
+	threads := map[string]threadPosition{}
+	for _, m := range messages {
+		root := groups.find("key:" + m.key)
+		thread, ok := threads[root]
+		if !ok {
+			thread = threadPosition{id: m.docID}
+		} else {
+			thread.position++
+		}
+		threads[root] = thread
+		index[m.key] = thread
+	}
+	return index
+}
+
+// rawMessage reads the email i of a batch, unquoted if it is an mbox message
+func rawMessage(b batch, i int) ([]byte, error) {
+	var section mboxSection
+	if b.sections != nil {
+		section = b.sections[i]
+	}
+	switch {
+	case b.contents != nil && section.length == 0:
+		return b.contents[i], nil
+	case b.contents != nil:
+		return unquoteMbox(b.contents[i]), nil
+	case section.length == 0:
+		return ioutil.ReadFile(b.paths[i])
+	}
+	file, err := os.Open(b.paths[i])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, section.length)
+	if _, err := file.ReadAt(data, section.offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return unquoteMbox(data), nil
+}
+
+// collectThreads reads the headers of every email produced by the source with a pool of parsers and builds
+// the thread index. The emails that cannot be read are left out; the indexing pass reports them.
+func collectThreads(ctx context.Context, source batchSource, parsers int, window time.Duration) (threadIndex, error) {
+	if parsers < 1 {
+		parsers = 1
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	batches := make(chan batch)
+	g.Go(func() error {
+		defer close(batches)
+		return source(ctx, batches)
+	})
+
+	var mu sync.Mutex
+	var messages []threadMessage
+	for i := 0; i < parsers; i++ {
+		g.Go(func() error {
+			for b := range batches {
+				found := make([]threadMessage, 0, len(b.paths))
+				for i := range b.paths {
+					raw, err := rawMessage(b, i)
+					if err != nil {
+						continue
+					}
+					var offset *int64
+					if b.sections != nil && b.sections[i].length > 0 {
+						offset = &b.sections[i].offset
+					}
+					found = append(found, newThreadMessage(raw, sourceName(b.paths[i], offset)))
+				}
+				mu.Lock()
+				messages = append(messages, found...)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return buildThreads(messages, window), nil
+}
+
+// indexedEmail is what a threadFinder returns about an email that is already indexed
+type indexedEmail struct {
+	ID       string
+	ThreadID string
+	Subject  string
+}
+
+// thread returns the thread of the indexed email. An email indexed without threads starts its own.
+func (e indexedEmail) thread() string {
+	if e.ThreadID != "" {
+		return e.ThreadID
+	}
+	return e.ID
+}
+
+// threadFinder is implemented by the sinks that can search the indexed emails, so the emails of incremental and
+// watch runs, which only read the new emails, join the threads of the emails indexed before
+type threadFinder interface {
+	// FindMessage returns the indexed email with the message id, given without angle brackets, or nil
+	FindMessage(ctx context.Context, messageID string) (*indexedEmail, error)
+	// FindSubject returns, newest first, the indexed emails sent between from and to whose subject matches subject
+	FindSubject(ctx context.Context, subject string, from, to time.Time) ([]indexedEmail, error)
+	// ThreadLength returns the highest position of the thread plus one, or zero if no email has the thread id
+	ThreadLength(ctx context.Context, threadID string) (int, error)
+}
+
+// resolvedSubject is the latest email of a subject placed in a thread by a threadResolver
+type resolvedSubject struct {
+	thread string
+	date   time.Time
+}
+
+// threadResolver places the emails of incremental and watch runs in threads as they are parsed, with the rules of
+// buildThreads, by looking up the emails they refer to in the index. The emails resolved by the run are kept too,
+// since they may not be searchable yet. Its methods do nothing on a nil resolver.
+type threadResolver struct {
+	finder threadFinder
+	window time.Duration
+
+	mu sync.Mutex
+	// messages maps the message ids seen by the run, of the emails and of the emails they refer to, to their thread
+	messages map[string]string
+	// subjects holds the latest email of every normalized subject seen by the run
+	subjects map[string]resolvedSubject
+	// next is the next position of the threads the run added emails to
+	next map[string]int
+}
+
+// newThreadResolver returns a resolver that looks up the indexed emails with finder
+func newThreadResolver(finder threadFinder, window time.Duration) *threadResolver {
+	return &threadResolver{
+		finder:   finder,
+		window:   window,
+		messages: map[string]string{},
+		subjects: map[string]resolvedSubject{},
+		next:     map[string]int{},
+	}
+}
+
+// emailThreadMessage returns what thread reconstruction needs to know about a parsed email
+func emailThreadMessage(email *EmailJson) threadMessage {
+	header := mail.Header(email.Header)
+	m := threadMessage{
+		key:       sourceName(email.SourcePath, email.SourceOffset),
+		docID:     email.ID,
+		messageID: normalizeMessageID(email.MessageID),
+	}
+	for _, field := range []string{"References", "In-Reply-To"} {
+		for _, value := range header[field] {
+			m.parents = append(m.parents, referencedIDs(value)...)
+		}
+	}
+	m.subject, m.reply = normalizeSubject(email.Subject)
+	m.date, _ = time.Parse(time.RFC3339, email.Date)
+	return m
+}
+
+// resolve fills the thread fields of the email. An email that refers to no known email, and is not a reply
+// matched by subject, starts a thread; otherwise it is added at the end of the thread it belongs to.
+func (r *threadResolver) resolve(ctx context.Context, email *EmailJson) error {
+	if r == nil {
+		return nil
+	}
+	m := emailThreadMessage(email)
+	thread, err := r.find(ctx, m)
+	if err != nil {
+		return err
+	}
+	position := 0
+	if thread == "" {
+		thread = m.docID
+	} else if position, err = r.finder.ThreadLength(ctx, thread); err != nil {
+		return err
+	} else if position == 0 {
+		// The email found was indexed without threads and starts the thread
+		position = 1
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if next := r.next[thread]; next > position {
+		position = next
+	}
+	r.next[thread] = position + 1
+	for _, id := range append(m.parents, m.messageID) {
+		if _, ok := r.messages[id]; !ok && id != "" {
+			r.messages[id] = thread
+		}
+	}
+	if latest, ok := r.subjects[m.subject]; m.subject != "" && !m.date.IsZero() && (!ok || !m.date.Before(latest.date)) {
+		r.subjects[m.subject] = resolvedSubject{thread: thread, date: m.date}
+	}
+	email.ThreadID = thread
+	email.ThreadPosition = &position
+	return nil
+}
+
+// find returns the thread of the first email the message refers to, or for a reply without references the
+// thread of the latest email with the same subject sent within the window. It returns "" if there is none.
+func (r *threadResolver) find(ctx context.Context, m threadMessage) (string, error) {
+	for _, parent := range m.parents {
+		r.mu.Lock()
+		thread, ok := r.messages[parent]
+		r.mu.Unlock()
+		if ok {
+			return thread, nil
+		}
+		found, err := r.finder.FindMessage(ctx, parent)
+		if err != nil {
+			return "", err
+		}
+		if found != nil {
+			return found.thread(), nil
+		}
+	}
+	if len(m.parents) > 0 || !m.reply || m.subject == "" || m.date.IsZero() {
+		return "", nil
+	}
+
+	r.mu.Lock()
+	latest, ok := r.subjects[m.subject]
+	r.mu.Unlock()
+	if ok && !latest.date.After(m.date) && m.date.Sub(latest.date) <= r.window {
+		return latest.thread, nil
+	}
+	candidates, err := r.finder.FindSubject(ctx, m.subject, m.date.Add(-r.window), m.date)
+	if err != nil {
+		return "", err
+	}
+	// The search matches the words of the subject, so the candidates are checked against the normalized subject
+	for _, candidate := range candidates {
+		if subject, _ := normalizeSubject(candidate.Subject); subject == m.subject && candidate.ID != m.docID {
+			return candidate.thread(), nil
+		}
+	}
+	return "", nil
+}
+
+func (s *zincSink) FindMessage(ctx context.Context, messageID string) (*indexedEmail, error) {
+	// The message_id field keeps the angle brackets of the header
+	query := map[string]interface{}{
+		"search_type": "term",
+		"query":       map[string]string{"term": "<" + messageID + ">", "field": "message_id"},
+		"_source":     []string{"subject", "thread_id"},
+		"max_results": 1,
+	}
+	found, err := searchIndexedEmails(ctx, s.url, s.index, s.auth, query)
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	return &found[0], nil
+}
+
+func (s *zincSink) FindSubject(ctx context.Context, subject string, from, to time.Time) ([]indexedEmail, error) {
+	query := map[string]interface{}{
+		"search_type": "matchphrase",
+		"query": map[string]string{
+			"term":       subject,
+			"field":      "subject",
+			"start_time": from.Format(time.RFC3339),
+			"end_time":   to.Format(time.RFC3339),
+		},
+		"sort_fields": []string{"-@timestamp"},
+		"_source":     []string{"subject", "thread_id"},
+		"max_results": 20,
+	}
+	return searchIndexedEmails(ctx, s.url, s.index, s.auth, query)
+}
+
+func (s *zincSink) ThreadLength(ctx context.Context, threadID string) (int, error) {
+	query := map[string]interface{}{
+		"search_type": "term",
+		"query":       map[string]string{"term": threadID, "field": "thread_id"},
+		"sort_fields": []string{"-thread_position"},
+		"_source":     []string{"thread_position"},
+		"max_results": 1,
+	}
+	var hits zincThreadHits
+	if err := zincRequest(ctx, s.auth, "POST", s.url+"/"+s.index+"/_search", query, &hits); err != nil {
+		return 0, err
+	}
+	if len(hits.Hits.Hits) == 0 || hits.Hits.Hits[0].Source.ThreadPosition == nil {
+		return 0, nil
+	}
+	return *hits.Hits.Hits[0].Source.ThreadPosition + 1, nil
+}
+
+// newSinkThreadResolver returns a resolver that looks up the threads in the index of the sink, or nil if threads
+// are not set or the sink cannot search its index
+func newSinkThreadResolver(sink Sink, opts Options) *threadResolver {
+	finder, ok := sink.(threadFinder)
+	if !opts.Threads || !ok {
+		return nil
+	}
+	return newThreadResolver(finder, opts.ThreadWindow)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSubject(t *testing.T) {
+	tests := []struct {
+		subject, expected string
+		reply             bool
+	}{
+		{"Meeting tomorrow", "meeting tomorrow", false},
+		{"RE: Meeting  tomorrow", "meeting tomorrow", true},
+		{"Fw: RE: re[2]: Meeting tomorrow", "meeting tomorrow", true},
+		{"FWD:Meeting tomorrow", "meeting tomorrow", true},
+		{"Results of the review", "results of the review", false},
+		{"RE:", "", true},
+	}
+	for _, test := range tests {
+		if got, reply := normalizeSubject(test.subject); got != test.expected || reply != test.reply {
+			t.Errorf("normalizeSubject(%q) = %q, %v, expected: %q, %v", test.subject, got, reply, test.expected, test.reply)
+		}
+	}
+}
+
+func TestReferencedIDs(t *testing.T) {
+	got := referencedIDs("<a@example.com> <b@example.com>\n <c@example.com>")
+	if expected := []string{"a@example.com", "b@example.com", "c@example.com"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("referencedIDs did not parse the ids. Got: %v, expected: %v", got, expected)
+	}
+	if got := referencedIDs("d@example.com"); !reflect.DeepEqual(got, []string{"d@example.com"}) {
+		t.Errorf("referencedIDs did not keep an id without brackets. Got: %v", got)
+	}
+	if got := referencedIDs("your message of Monday"); got != nil {
+		t.Errorf("referencedIDs parsed free text as an id. Got: %v", got)
+	}
+}
+
+// threadTestMessage returns a threadMessage with its subject normalized, sent the given hours after a fixed date
+func threadTestMessage(key, messageID, subject string, hours int, parents ...string) threadMessage {
+	m := threadMessage{key: key, docID: "doc-" + key, messageID: messageID, parents: parents}
+	m.subject, m.reply = normalizeSubject(subject)
+	m.date = time.Date(2001, 5, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(hours) * time.Hour)
+	return m
+}
+
+func TestBuildThreads(t *testing.T) {
+	messages := []threadMessage{
+		// A conversation linked by its headers, delivered out of order
+		threadTestMessage("reply2", "3@x", "RE: Budget", 5, "1@x", "2@x"),
+		threadTestMessage("root", "1@x", "Budget", 0),
+		threadTestMessage("reply1", "2@x", "RE: Budget", 2, "1@x"),
+		// Two replies to an email that is not in the input
+		threadTestMessage("orphan1", "5@x", "RE: Lost", 1, "4@x"),
+		threadTestMessage("orphan2", "6@x", "RE: Lost", 3, "4@x"),
+		// A conversation without headers, matched by subject within the window
+		threadTestMessage("plain", "", "Gas prices", 10),
+		threadTestMessage("plainReply", "", "Re: gas  prices", 30),
+		threadTestMessage("plainFwd", "", "FW: RE: Gas prices", 40),
+		// A reply sent long after the window starts its own thread, and so does an email that is not a reply
+		threadTestMessage("late", "", "RE: Gas prices", 40+24*30),
+		threadTestMessage("sameSubject", "", "Gas prices", 41),
+	}
+	threads := buildThreads(messages, 7*24*time.Hour)
+
+	expected := map[string]threadPosition{
+		"root":        {"doc-root", 0},
+		"reply1":      {"doc-root", 1},
+		"reply2":      {"doc-root", 2},
+		"orphan1":     {"doc-orphan1", 0},
+		"orphan2":     {"doc-orphan1", 1},
+		"plain":       {"doc-plain", 0},
+		"plainReply":  {"doc-plain", 1},
+		"plainFwd":    {"doc-plain", 2},
+		"sameSubject": {"doc-sameSubject", 0},
+		"late":        {"doc-late", 0},
+	}
+	for key, thread := range expected {
+		if threads[key] != thread {
+			t.Errorf("buildThreads did not place %s in its thread. Got: %+v, expected: %+v", key, threads[key], thread)
+		}
+	}
+}
+
+func TestCollectThreads(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "threads")
+	defer os.RemoveAll(tempDir)
+	ioutil.WriteFile(filepath.Join(tempDir, "1."), []byte("Message-ID: <1@x>\nDate: Mon, 14 May 2001 16:39:00 -0700\nSubject: Budget\n\nfirst"), 0644)
+	ioutil.WriteFile(filepath.Join(tempDir, "2."), []byte("Message-ID: <2@x>\nDate: Mon, 14 May 2001 18:39:00 -0700\nIn-Reply-To: <1@x>\nSubject: RE: Budget\n\nsecond"), 0644)
+	mbox := writeTestMbox(t, tempDir)
+
+	threads, err := collectThreads(context.Background(), maildirSource(tempDir, FormatAuto, 2, nil), 2, time.Hour)
+	if err != nil {
+		t.Fatalf("collectThreads returned an error: %v", err)
+	}
+	if len(threads) != 5 {
+		t.Errorf("collectThreads did not read every email. Got: %d, expected: 5", len(threads))
+	}
+
+	reply, err := parseEmail(filepath.Join(tempDir, "2."))
+	if err != nil {
+		t.Fatalf("parseEmail returned an error: %v", err)
+	}
+	threads.set(reply)
+	if reply.ThreadID != "1@x" || reply.ThreadPosition == nil || *reply.ThreadPosition != 1 {
+		t.Errorf("the reply was not placed after its parent. Got: %s, %v", reply.ThreadID, reply.ThreadPosition)
+	}
+	offset := int64(0)
+	first := &EmailJson{SourcePath: mbox, SourceOffset: &offset}
+	threads.set(first)
+	if first.ThreadID != "1@example.com" {
+		t.Errorf("the mbox message was not found by its offset. Got: %s", first.ThreadID)
+	}
+
+	var none threadIndex
+	none.set(reply)
+}
+
+// fakeThreadFinder finds the emails of a slice, as if they were indexed
+type fakeThreadFinder struct {
+	emails []struct {
+		messageID string
+		date      time.Time
+		email     indexedEmail
+		position  int
+	}
+}
+
+func (f *fakeThreadFinder) add(messageID, id, thread, subject string, date time.Time, position int) {
+	f.emails = append(f.emails, struct {
+		messageID string
+		date      time.Time
+		email     indexedEmail
+		position  int
+	}{messageID, date, indexedEmail{ID: id, ThreadID: thread, Subject: subject}, position})
+}
+
+func (f *fakeThreadFinder) FindMessage(ctx context.Context, messageID string) (*indexedEmail, error) {
+	for _, e := range f.emails {
+		if e.messageID == messageID {
+			return &e.email, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeThreadFinder) FindSubject(ctx context.Context, subject string, from, to time.Time) ([]indexedEmail, error) {
+	var found []indexedEmail
+	for i := len(f.emails) - 1; i >= 0; i-- {
+		e := f.emails[i]
+		if !e.date.Before(from) && !e.date.After(to) && strings.Contains(strings.ToLower(e.email.Subject), subject) {
+			found = append(found, e.email)
+		}
+	}
+	return found, nil
+}
+
+func (f *fakeThreadFinder) ThreadLength(ctx context.Context, threadID string) (int, error) {
+	length := 0
+	for _, e := range f.emails {
+		if e.email.ThreadID == threadID && e.position+1 > length {
+			length = e.position + 1
+		}
+	}
+	return length, nil
+}
+
+// resolverTestEmail returns a parsed email sent the given hours after a fixed date
+func resolverTestEmail(id, messageID, subject string, hours int, inReplyTo string) *EmailJson {
+	email := &EmailJson{ID: id, MessageID: "<" + messageID + ">", Subject: subject, Header: map[string][]string{}}
+	if inReplyTo != "" {
+		email.Header["In-Reply-To"] = []string{"<" + inReplyTo + ">"}
+	}
+	email.Date = time.Date(2001, 5, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(hours) * time.Hour).Format(time.RFC3339)
+	return email
+}
+
+func TestThreadResolver(t *testing.T) {
+	base := time.Date(2001, 5, 1, 0, 0, 0, 0, time.UTC)
+	finder := &fakeThreadFinder{}
+	finder.add("1@x", "doc-1", "doc-1", "Budget", base, 0)
+	finder.add("2@x", "doc-2", "doc-1", "RE: Budget", base.Add(time.Hour), 1)
+	// An email indexed without threads
+	finder.add("3@x", "doc-3", "", "Gas prices", base, 0)
+	resolver := newThreadResolver(finder, 7*24*time.Hour)
+
+	tests := []struct {
+		email    *EmailJson
+		thread   string
+		position int
+	}{
+		// A reply to an indexed email is added at the end of its thread
+		{resolverTestEmail("doc-4", "4@x", "RE: Budget", 2, "1@x"), "doc-1", 2},
+		// A reply to an email of the same run, which may not be searchable yet
+		{resolverTestEmail("doc-5", "5@x", "RE: Budget", 3, "4@x"), "doc-1", 3},
+		// A reply without references is matched by subject, and joins the thread of an email indexed without one
+		{resolverTestEmail("doc-6", "6@x", "Re: gas prices", 4, ""), "doc-3", 1},
+		// An email that is not a reply starts a thread
+		{resolverTestEmail("doc-7", "7@x", "Budget", 5, ""), "doc-7", 0},
+		// Replies to a missing email share a thread
+		{resolverTestEmail("doc-8", "8@x", "RE: Lost", 6, "missing@x"), "doc-8", 0},
+		{resolverTestEmail("doc-9", "9@x", "RE: Lost", 7, "missing@x"), "doc-8", 1},
+	}
+	for _, test := range tests {
+		if err := resolver.resolve(context.Background(), test.email); err != nil {
+			t.Fatalf("resolve returned an error: %v", err)
+		}
+		if test.email.ThreadID != test.thread || test.email.ThreadPosition == nil || *test.email.ThreadPosition != test.position {
+			t.Errorf("resolve did not place %s in its thread. Got: %s, %v, expected: %s, %d", test.email.ID, test.email.ThreadID, test.email.ThreadPosition, test.thread, test.position)
+		}
+	}
+
+	var none *threadResolver
+	if err := none.resolve(context.Background(), &EmailJson{}); err != nil {
+		t.Errorf("a nil resolver returned an error: %v", err)
+	}
+}
+
+func TestZincThreadFinder(t *testing.T) {
+	var queries []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&query)
+		queries = append(queries, query)
+		w.Write([]byte(`{"hits":{"hits":[{"_id":"doc-2","_source":{"subject":"RE: Budget","thread_id":"doc-1","thread_position":4}}]}}`))
+	}))
+	defer ts.Close()
+	sink := newZincSink(ts.URL, INDEX, credentials{}, false)
+
+	found, err := sink.FindMessage(context.Background(), "2@x")
+	if err != nil || found == nil || found.thread() != "doc-1" {
+		t.Errorf("FindMessage did not return the indexed email. Got: %+v, %v", found, err)
+	}
+	if term := queries[0]["query"].(map[string]interface{})["term"]; term != "<2@x>" {
+		t.Errorf("FindMessage did not search the message id with its angle brackets. Got: %v", term)
+	}
+	if length, err := sink.ThreadLength(context.Background(), "doc-1"); err != nil || length != 5 {
+		t.Errorf("ThreadLength did not return the position after the last one. Got: %d, %v", length, err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// versionLayout formats the time a versioned index is built at, so the names of the versions sort by age
+const versionLayout = "20060102150405"
+
+// indexVersioner is implemented by the sinks that can build a versioned index and point an alias at it
+type indexVersioner interface {
+	// CountDocuments returns the number of documents in the index the sink writes to
+	CountDocuments(ctx context.Context) (int, error)
+	// ListIndexes returns the names of the indexes that start with prefix
+	ListIndexes(ctx context.Context, prefix string) ([]string, error)
+	// AliasIndexes returns the names of the indexes the alias points at
+	AliasIndexes(ctx context.Context, alias string) ([]string, error)
+	// SwitchAlias atomically points the alias at the index the sink writes to, removes it from the previous indexes
+	// and adds the index to the history alias
+	SwitchAlias(ctx context.Context, alias, history string, previous []string) error
+	// DeleteIndex deletes an index
+	DeleteIndex(ctx context.Context, index string) error
+}
+
+func (s *zincSink) CountDocuments(ctx context.Context) (int, error) {
+	return countDocuments(ctx, s.url, s.index, s.auth)
+}
+
+func (s *zincSink) ListIndexes(ctx context.Context, prefix string) ([]string, error) {
+	return listIndexes(ctx, s.url, prefix, s.auth)
+}
+
+func (s *zincSink) AliasIndexes(ctx context.Context, alias string) ([]string, error) {
+	return aliasIndexes(ctx, s.url, alias, s.auth)
+}
+
+func (s *zincSink) SwitchAlias(ctx context.Context, alias, history string, previous []string) error {
+	return switchAlias(ctx, s.url, alias, history, s.index, previous, s.auth)
+}
+
+func (s *zincSink) DeleteIndex(ctx context.Context, index string) error {
+	return deleteIndex(ctx, s.url, index, s.auth)
+}
+
+// versionedIndex returns the name of the version of the alias built at the given time, e.g. email_v20261017093000
+func versionedIndex(alias string, at time.Time) string {
+	return alias + "_v" + at.UTC().Format(versionLayout)
+}
+
+// historyAlias returns the alias that points at every published version of the alias, so the versions that
+// were built but never published are not kept for rollback
+func historyAlias(alias string) string {
+	return alias + "_published"
+}
+
+// indexVersions returns, oldest first, the names that are versions of the alias
+func indexVersions(alias string, names []string) []string {
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(alias) + `_v\d{14}$`)
+	var versions []string
+	for _, name := range names {
+		if pattern.MatchString(name) {
+			versions = append(versions, name)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// documentIDs collects the ids of the documents acknowledged by the server. Emails with the same id overwrite
+// each other, so its size is the number of documents the index should hold. Its methods do nothing on a nil set.
+type documentIDs struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+	// anonymous counts the emails without an id, which the server gives a new id every time
+	anonymous int
+}
+
+// add records the ids of the emails
+func (d *documentIDs) add(emails []*EmailJson) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ids == nil {
+		d.ids = map[string]struct{}{}
+	}
+	for _, email := range emails {
+		if email.ID == "" {
+			d.anonymous++
+			continue
+		}
+		d.ids[email.ID] = struct{}{}
+	}
+}
+
+// count returns the number of distinct ids plus the number of emails without an id
+func (d *documentIDs) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.ids) + d.anonymous
+}
+
+// validateCount waits until the index holds the expected number of documents, since the server may take a
+// moment to make the last batches searchable. It returns an error if the count is still different after the
+// attempts of the retry policy.
+func validateCount(ctx context.Context, versioner indexVersioner, expected int, retry retryPolicy) error {
+	attempts := retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	count := 0
+	for attempt := 1; ; attempt++ {
+		var err error
+		if count, err = versioner.CountDocuments(ctx); err != nil {
+			return fmt.Errorf("error counting documents: %w", err)
+		}
+		if count == expected {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+		select {
+		case <-time.After(retry.backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fmt.Errorf("the index holds %d documents, expected %d", count, expected)
+}
+
+// discardVersion deletes a version that was not published, if it was created. It runs when the build has
+// already failed, so an error is only logged.
+func discardVersion(ctx context.Context, versioner indexVersioner, index string) {
+	names, err := versioner.ListIndexes(ctx, index)
+	if err == nil {
+		for _, name := range names {
+			if name == index {
+				err = versioner.DeleteIndex(ctx, index)
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error deleting unpublished version %s: %v", index, err)
+		return
+	}
+	log.Printf("Deleted unpublished version %s", index)
+}
+
+// publishVersion validates the document count of the versioned index the sink wrote to and points the alias at it.
+// An index that has the name of the alias is only deleted to make room for it if replace is set. A version that
+// is not published is deleted, unless that index was already deleted. The newest retention previously published
+// versions are kept for rollback and the older ones are deleted, as are the older versions that were never published.
+func publishVersion(ctx context.Context, versioner indexVersioner, alias, index string, expected int, retention int, replace bool, retry retryPolicy) error {
+	published, names, err := switchVersion(ctx, versioner, alias, index, expected, replace, retry)
+	if err != nil {
+		return err
+	}
+	log.Printf("Alias %s now points at %s with %d documents", alias, index, expected)
+
+	history, err := versioner.AliasIndexes(ctx, historyAlias(alias))
+	if err != nil {
+		return err
+	}
+	for _, name := range history {
+		published[name] = true
+	}
+	// A version that was never published and is older than this one was left by a build that failed or was
+	// killed; the newer ones may still be building
+	var previous []string
+	for _, version := range indexVersions(alias, names) {
+		switch {
+		case version == index:
+		case published[version]:
+			previous = append(previous, version)
+		case version < index:
+			log.Printf("Deleting version %s, which was never published", version)
+			if err := versioner.DeleteIndex(ctx, version); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Keeping version %s, which may still be building", version)
+		}
+	}
+
+	if retention < 0 {
+		retention = 0
+	}
+	if len(previous) <= retention {
+		return nil
+	}
+	for _, old := range previous[:len(previous)-retention] {
+		log.Printf("Deleting old version %s", old)
+		if err := versioner.DeleteIndex(ctx, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// switchVersion validates the versioned index and points the alias at it. It returns the set of versions the alias
+// pointed at before, which were published before the history alias recorded them, and the names of the indexes.
+// The version is deleted if it cannot be published, unless the index with the name of the alias was deleted.
+func switchVersion(ctx context.Context, versioner indexVersioner, alias, index string, expected int, replace bool, retry retryPolicy) (published map[string]bool, names []string, err error) {
+	// replaced is set once the index with the name of the alias is deleted; the version is then the only copy of
+	// the emails, so it is kept for the alias to be pointed at it by hand
+	replaced := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if replaced {
+			err = fmt.Errorf("index %s was deleted but alias %s could not be pointed at %s, which is kept; point the alias at it by hand: %w", alias, alias, index, err)
+			return
+		}
+		discardVersion(ctx, versioner, index)
+		err = fmt.Errorf("%s was not published: %w", index, err)
+	}()
+
+	if err := validateCount(ctx, versioner, expected, retry); err != nil {
+		return nil, nil, err
+	}
+
+	names, err = versioner.ListIndexes(ctx, alias)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range names {
+		if name != alias {
+			continue
+		}
+		if !replace {
+			return nil, nil, fmt.Errorf("%s is an index, not an alias; use -recreate-index to replace it with an alias to %s", alias, index)
+		}
+		log.Printf("Deleting index %s so the name can be an alias", alias)
+		if err := versioner.DeleteIndex(ctx, alias); err != nil {
+			return nil, nil, err
+		}
+		replaced = true
+	}
+
+	holders, err := versioner.AliasIndexes(ctx, alias)
+	if err != nil {
+		return nil, nil, err
+	}
+	published = map[string]bool{}
+	for _, name := range holders {
+		published[name] = true
+	}
+	var previous []string
+	for _, version := range indexVersions(alias, names) {
+		if version != index {
+			previous = append(previous, version)
+		}
+	}
+	err = retry.do(ctx, "point alias "+alias+" at "+index, func() error {
+		return versioner.SwitchAlias(ctx, alias, historyAlias(alias), previous)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error pointing alias %s at %s: %w", alias, index, err)
+	}
+	return published, names, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeVersionServer emulates the Zinc APIs used to publish a versioned index and records the requests it gets
+type fakeVersionServer struct {
+	indexes []string
+	count   int
+	// aliases maps every alias to the indexes it points at
+	aliases map[string][]string
+	// actions are the actions of the last _aliases request
+	actions interface{}
+	// aliasesStatus, if set, is the status code every _aliases request fails with
+	aliasesStatus int
+	requests      []string
+}
+
+func (f *fakeVersionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_search"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"hits": map[string]interface{}{"total": map[string]int{"value": f.count}}})
+	case r.URL.Path == "/api/index_name":
+		json.NewEncoder(w).Encode(f.indexes)
+	case strings.HasPrefix(r.URL.Path, "/es/_alias/"):
+		alias := strings.TrimPrefix(r.URL.Path, "/es/_alias/")
+		if len(f.aliases[alias]) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		response := map[string]interface{}{}
+		for _, index := range f.aliases[alias] {
+			response[index] = map[string]interface{}{"aliases": map[string]interface{}{alias: map[string]interface{}{}}}
+		}
+		json.NewEncoder(w).Encode(response)
+	case r.URL.Path == "/es/_aliases" && f.aliasesStatus != 0:
+		w.WriteHeader(f.aliasesStatus)
+	case r.URL.Path == "/es/_aliases":
+		var body struct {
+			Actions []map[string]aliasAction `json:"actions"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.actions = body.Actions
+		if f.aliases == nil {
+			f.aliases = map[string][]string{}
+		}
+		for _, action := range body.Actions {
+			if add, ok := action["add"]; ok {
+				f.aliases[add.Alias] = append(f.aliases[add.Alias], add.Index)
+			}
+			if remove, ok := action["remove"]; ok {
+				f.aliases[remove.Alias] = removeName(f.aliases[remove.Alias], remove.Index)
+			}
+		}
+	case r.Method == "DELETE":
+		name := strings.TrimPrefix(r.URL.Path, "/api/index/")
+		f.indexes = removeName(f.indexes, name)
+		for alias, indexes := range f.aliases {
+			f.aliases[alias] = removeName(indexes, name)
+		}
+	}
+}
+
+// removeName returns the names without name
+func removeName(names []string, name string) []string {
+	var kept []string
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// testVersionRetry does not wait between the count checks
+var testVersionRetry = retryPolicy{MaxAttempts: 2}
+
+func TestVersionedIndex(t *testing.T) {
+	at := time.Date(2026, 10, 17, 9, 30, 0, 0, time.UTC)
+	if got := versionedIndex("email", at); got != "email_v20261017093000" {
+		t.Errorf("versionedIndex did not name the version by date. Got: %s, expected: email_v20261017093000", got)
+	}
+	names := []string{"email_v20261017093000", "email", "email_archive", "email_v20250101000000", "email_v1"}
+	expected := []string{"email_v20250101000000", "email_v20261017093000"}
+	if got := indexVersions("email", names); !reflect.DeepEqual(got, expected) {
+		t.Errorf("indexVersions did not list the versions oldest first. Got: %v, expected: %v", got, expected)
+	}
+}
+
+func TestPublishVersion(t *testing.T) {
+	fake := &fakeVersionServer{
+		indexes: []string{"email_v20261015000000", "email_v20261016000000", "email_v20261014000000", "email_v20261016120000", "email_v20261017000000", "email_v20261018000000", "email_archive"},
+		count:   3,
+		// email_v20261016000000 was published before the history alias was kept, email_v20261016120000 failed and
+		// email_v20261018000000 is still building
+		aliases: map[string][]string{"email": {"email_v20261016000000"}, "email_published": {"email_v20261014000000", "email_v20261015000000"}},
+	}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	sink := newZincSink(ts.URL+"/api", "email_v20261017000000", credentials{}, false)
+
+	if err := publishVersion(context.Background(), sink, "email", "email_v20261017000000", 3, 2, false, testVersionRetry); err != nil {
+		t.Fatalf("publishVersion returned an error: %v", err)
+	}
+
+	actions, _ := json.Marshal(fake.actions)
+	expected := `[{"remove":{"index":"email_v20261014000000","alias":"email","must_exist":false}},` +
+		`{"remove":{"index":"email_v20261015000000","alias":"email","must_exist":false}},` +
+		`{"remove":{"index":"email_v20261016000000","alias":"email","must_exist":false}},` +
+		`{"remove":{"index":"email_v20261016120000","alias":"email","must_exist":false}},` +
+		`{"remove":{"index":"email_v20261018000000","alias":"email","must_exist":false}},` +
+		`{"add":{"index":"email_v20261017000000","alias":"email"}},` +
+		`{"add":{"index":"email_v20261017000000","alias":"email_published"}}]`
+	if string(actions) != expected {
+		t.Errorf("publishVersion did not switch the alias in a single request. Got: %s, expected: %s", actions, expected)
+	}
+
+	// Only the published versions count toward the retention, so the failed build does not push out a rollback target.
+	// The failed build is deleted, while the newer one is left to finish.
+	remaining := []string{"email_v20261015000000", "email_v20261016000000", "email_v20261017000000", "email_v20261018000000", "email_archive"}
+	if !reflect.DeepEqual(fake.indexes, remaining) {
+		t.Errorf("publishVersion did not keep the newest previously published versions. Got: %v, expected: %v", fake.indexes, remaining)
+	}
+	if !reflect.DeepEqual(fake.aliases["email"], []string{"email_v20261017000000"}) {
+		t.Errorf("publishVersion did not point the alias at the new version only. Got: %v", fake.aliases["email"])
+	}
+}
+
+func TestPublishVersionCountMismatch(t *testing.T) {
+	fake := &fakeVersionServer{indexes: []string{"email_v20261016000000", "email_v20261017000000"}, count: 2}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	sink := newZincSink(ts.URL+"/api", "email_v20261017000000", credentials{}, false)
+
+	if err := publishVersion(context.Background(), sink, "email", "email_v20261017000000", 3, 2, false, testVersionRetry); err == nil {
+		t.Fatalf("publishVersion did not return an error for a missing document")
+	}
+	if fake.actions != nil || !reflect.DeepEqual(fake.indexes, []string{"email_v20261016000000"}) {
+		t.Errorf("publishVersion did not only delete the invalid version. Got indexes: %v, requests: %v", fake.indexes, fake.requests)
+	}
+}
+
+func TestPublishVersionConcreteIndex(t *testing.T) {
+	// The alias cannot have the name of an existing index unless it is replaced
+	fake := &fakeVersionServer{indexes: []string{"email", "email_v20261017000000"}, count: 1}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	sink := newZincSink(ts.URL+"/api", "email_v20261017000000", credentials{}, false)
+	if err := publishVersion(context.Background(), sink, "email", "email_v20261017000000", 1, 2, false, testVersionRetry); err == nil {
+		t.Errorf("publishVersion did not return an error for an index with the name of the alias")
+	}
+	if !reflect.DeepEqual(fake.indexes, []string{"email"}) || fake.actions != nil {
+		t.Errorf("publishVersion did not keep the index and delete the unpublished version. Got: %v", fake.indexes)
+	}
+
+	fake = &fakeVersionServer{indexes: []string{"email", "email_v20261017000000"}, count: 1}
+	ts = httptest.NewServer(fake)
+	defer ts.Close()
+	sink = newZincSink(ts.URL+"/api", "email_v20261017000000", credentials{}, false)
+	if err := publishVersion(context.Background(), sink, "email", "email_v20261017000000", 1, 2, true, testVersionRetry); err != nil {
+		t.Fatalf("publishVersion returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(fake.indexes, []string{"email_v20261017000000"}) || fake.actions == nil {
+		t.Errorf("publishVersion did not replace the index with the alias. Got: %v", fake.indexes)
+	}
+}
+
+func TestPublishVersionReplacedIndexKept(t *testing.T) {
+	fake := &fakeVersionServer{indexes: []string{"email", "email_v20261017000000"}, count: 1, aliasesStatus: http.StatusInternalServerError}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	sink := newZincSink(ts.URL+"/api", "email_v20261017000000", credentials{}, false)
+
+	// Once the index with the name of the alias is deleted, the version is the only copy of the emails
+	err := publishVersion(context.Background(), sink, "email", "email_v20261017000000", 1, 2, true, testVersionRetry)
+	if err == nil || !strings.Contains(err.Error(), "email_v20261017000000") {
+		t.Errorf("publishVersion did not return an error naming the version. Got: %v", err)
+	}
+	if !reflect.DeepEqual(fake.indexes, []string{"email_v20261017000000"}) {
+		t.Errorf("publishVersion deleted the version after the index was replaced. Got: %v", fake.indexes)
+	}
+	switches := 0
+	for _, request := range fake.requests {
+		if request == "POST /es/_aliases" {
+			switches++
+		}
+	}
+	if switches != testVersionRetry.MaxAttempts {
+		t.Errorf("publishVersion did not retry switching the alias. Got: %d attempts, expected: %d", switches, testVersionRetry.MaxAttempts)
+	}
+}
+
+func TestDiscardVersion(t *testing.T) {
+	fake := &fakeVersionServer{indexes: []string{"email_v20261016000000"}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	sink := newZincSink(ts.URL+"/api", "email_v20261017000000", credentials{}, false)
+
+	// A version that failed before it was created is not deleted
+	discardVersion(context.Background(), sink, "email_v20261017000000")
+	for _, request := range fake.requests {
+		if strings.HasPrefix(request, "DELETE") {
+			t.Errorf("discardVersion deleted an index that does not exist. Got requests: %v", fake.requests)
+		}
+	}
+	discardVersion(context.Background(), sink, "email_v20261016000000")
+	if len(fake.indexes) != 0 {
+		t.Errorf("discardVersion did not delete the version. Got: %v", fake.indexes)
+	}
+}
+
+func TestDocumentIDs(t *testing.T) {
+	var none *documentIDs
+	none.add([]*EmailJson{{ID: "a"}})
+
+	ids := &documentIDs{}
+	ids.add([]*EmailJson{{ID: "a"}, {ID: "b"}})
+	ids.add([]*EmailJson{{ID: "a"}, {}, {}})
+	if ids.count() != 4 {
+		t.Errorf("documentIDs did not count the distinct ids and the emails without one. Got: %d, expected: 4", ids.count())
+	}
+}
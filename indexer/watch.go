@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pendingChange is the last change seen on a path that has not been indexed yet
+type pendingChange struct {
+	// at is the time of the last event, the change is indexed once no event arrived for the debounce delay
+	at time.Time
+	// removed is set when the file was deleted or moved away, so its documents are deleted
+	removed bool
+	// modified is set when a file that may already be indexed was written, so its old documents are replaced
+	modified bool
+}
+
+// watcher indexes the emails delivered to a maildir while it runs. The events of a path are debounced, so a
+// file is only read once its writes have settled, and the settled paths are indexed in micro-batches through
+// the upload path of the pipeline. A file moved inside the maildir, as from new/ to cur/ when it is read, is
+// indexed under its new path and the documents of its old path are deleted.
+type watcher struct {
+	root     string
+	events   *fsnotify.Watcher
+	pipeline *pipeline
+	debounce time.Duration
+	// dirs are the watched directories, to tell a removed folder from a removed email
+	dirs map[string]bool
+	// pending holds the paths with changes waiting for the debounce delay
+	pending map[string]*pendingChange
+	// manifestPath is the manifest of an incremental watch, loaded once the initial run has saved it. The
+	// changes indexed while watching are recorded in it, so a restart skips them.
+	manifestPath string
+	// saved is when the manifest was last saved and unsaved is set when it changed since
+	saved   time.Time
+	unsaved bool
+}
+
+// manifestSaveInterval is the shortest time between two saves of the manifest while watching
+const manifestSaveInterval = time.Minute
+
+// newWatcher watches every directory of the maildir except the Maildir tmp directories and the hidden ones
+func newWatcher(root string, sink Sink, deadLetters *deadLetters, opts Options) (*watcher, error) {
+	events, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		root:     root,
+		events:   events,
+		pipeline: &pipeline{sink: sink, root: root, deadLetters: deadLetters, resolver: newSinkThreadResolver(sink, opts), opts: opts},
+		debounce: opts.WatchDebounce,
+		dirs:     map[string]bool{},
+		pending:  map[string]*pendingChange{},
+	}
+	if err := w.addTree(root, false, time.Now()); err != nil {
+		events.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// skipPath reports whether a path of the maildir is not watched: a Maildir tmp directory, or a hidden
+// file or directory. Emails are written to tmp and only moved to new once complete.
+func (w *watcher) skipPath(path string) bool {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	return skipArchivePath(filepath.ToSlash(rel)) || filepath.Base(path) == maildirTmp
+}
+
+// addTree watches dir and its subdirectories. If queue is set the emails already in them are indexed, as
+// for a folder created or moved into the maildir, whose contents may be written before it is watched.
+func (w *watcher) addTree(dir string, queue bool, now time.Time) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip, err := skipEntry(w.root, path, d); skip || err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			if queue {
+				w.pending[path] = &pendingChange{at: now}
+			}
+			return nil
+		}
+		if err := w.events.Add(path); err != nil {
+			return fmt.Errorf("error watching %s: %w", path, err)
+		}
+		w.dirs[path] = true
+		return nil
+	})
+}
+
+// handle records the change described by an event
+func (w *watcher) handle(event fsnotify.Event, now time.Time) {
+	path := event.Name
+	if w.skipPath(path) {
+		return
+	}
+	switch {
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		if w.dirs[path] {
+			// The files of the folder are not known anymore, so their documents are left to a later run
+			log.Printf("Folder %s was moved or deleted, run with -incremental -delete-missing to delete its emails", path)
+			for dir := range w.dirs {
+				if dir == path || strings.HasPrefix(dir, path+string(filepath.Separator)) {
+					// A moved folder is still watched under its old name, a deleted one is already unwatched
+					w.events.Remove(dir)
+					delete(w.dirs, dir)
+				}
+			}
+			return
+		}
+		w.pending[path] = &pendingChange{at: now, removed: true}
+	case event.Has(fsnotify.Create):
+		info, err := os.Stat(path)
+		if err != nil {
+			// Removed again before the event was read
+			return
+		}
+		if info.IsDir() {
+			if err := w.addTree(path, true, now); err != nil {
+				log.Printf("Error watching folder %s: %v", path, err)
+			}
+			return
+		}
+		// A file moved over an existing email replaces it
+		change, replaced := w.pending[path]
+		w.pending[path] = &pendingChange{at: now, modified: replaced && (change.removed || change.modified)}
+	case event.Has(fsnotify.Write):
+		if change, ok := w.pending[path]; ok {
+			change.at = now
+			if change.removed {
+				change.removed, change.modified = false, true
+			}
+			return
+		}
+		w.pending[path] = &pendingChange{at: now, modified: true}
+	}
+}
+
+// settled removes from the pending changes, and returns sorted, the paths without events for the debounce
+// delay, or every path if all is set
+func (w *watcher) settled(now time.Time, all bool) (removed, written, modified []string) {
+	for path, change := range w.pending {
+		if !all && now.Sub(change.at) < w.debounce {
+			continue
+		}
+		delete(w.pending, path)
+		switch {
+		case change.removed:
+			removed = append(removed, path)
+		case change.modified:
+			written = append(written, path)
+			modified = append(modified, path)
+		default:
+			written = append(written, path)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(written)
+	sort.Strings(modified)
+	return removed, written, modified
+}
+
+// retry puts paths back in the pending changes, so a change that could not be indexed is tried again
+func (w *watcher) retry(paths []string, removed, modified bool, now time.Time) {
+	for _, path := range paths {
+		if _, ok := w.pending[path]; !ok {
+			w.pending[path] = &pendingChange{at: now, removed: removed, modified: modified}
+		}
+	}
+}
+
+// flush deletes the documents of the settled removed emails and indexes the settled written ones in batches
+// of up to BatchSize emails. The changes that fail are kept to be tried again on the next flush.
+func (w *watcher) flush(ctx context.Context, now time.Time, all bool) {
+	removed, written, modified := w.settled(now, all)
+	if len(removed) == 0 && len(written) == 0 {
+		return
+	}
+	deleter, ok := w.pipeline.sink.(sourceDeleter)
+	if !ok {
+		if len(removed) > 0 || len(modified) > 0 {
+			log.Printf("The sink cannot delete documents, %d removed and %d modified emails keep their old documents", len(removed), len(modified))
+		}
+		removed, modified = nil, nil
+	}
+	done, err := deleteSources(ctx, deleter, removed)
+	if err != nil {
+		log.Printf("Error deleting documents of %s, it is tried again later: %v", removed[done], err)
+		w.retry(removed[done:], true, false, now)
+	}
+	if manifest := w.pipeline.manifest; manifest != nil && done > 0 {
+		for _, path := range removed[:done] {
+			manifest.forget(path)
+		}
+		w.unsaved = true
+	}
+	if done, err := deleteSources(ctx, deleter, modified); err != nil {
+		// Indexing now would keep the old documents of the emails whose id changed, so every write waits
+		log.Printf("Error deleting documents of %s, it is tried again later: %v", modified[done], err)
+		w.retry(modified[done:], false, true, now)
+		w.retry(written, false, false, now)
+		return
+	}
+
+	batchSize := w.pipeline.opts.BatchSize
+	for start := 0; start < len(written); start += batchSize {
+		end := start + batchSize
+		if end > len(written) {
+			end = len(written)
+		}
+		paths := written[start:end]
+		messages := make([]*EmailJson, 0, len(paths))
+		for _, path := range paths {
+			email, err := parseEmailFile(path, w.pipeline.opts.Lenient)
+			if err != nil {
+				// Read errors are already logged, an email moved away before it was read is indexed under its new path
+				if errors.Is(err, errMalformedHeaders) {
+					log.Println(err)
+				}
+				w.pipeline.stats.addSkipped(1)
+				continue
+			}
+			setMailboxFields(email, w.root)
+			w.pipeline.resolveThread(ctx, email)
+			if manifest := w.pipeline.manifest; manifest != nil {
+				// The email is added to the manifest when the server acknowledges it
+				if err := manifest.track(path); err != nil {
+					log.Printf("Error recording %s in the manifest: %v", path, err)
+				}
+				w.unsaved = true
+			}
+			messages = append(messages, email)
+		}
+		if err := w.pipeline.upload(ctx, parsedBatch{batch: batch{paths: paths}, messages: messages}); err != nil {
+			log.Printf("Error indexing %d emails, they are tried again later: %v", len(paths), err)
+			w.retry(written[start:], false, false, now)
+			return
+		}
+		log.Printf("Indexed %d new or changed emails (%s)", len(messages), &w.pipeline.stats)
+	}
+}
+
+// deleteSources deletes the documents of the paths in order. It returns how many paths were done before an error.
+func deleteSources(ctx context.Context, deleter sourceDeleter, paths []string) (int, error) {
+	for i, path := range paths {
+		deleted, err := deleter.DeleteSource(ctx, path)
+		if err != nil {
+			return i, err
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d documents of %s", deleted, path)
+		}
+	}
+	return len(paths), nil
+}
+
+// run handles the events until ctx is cancelled, then indexes the pending changes and returns. Nothing is
+// indexed until initial delivers the result of the run that indexed the emails already in the maildir, which
+// is returned if it failed.
+func (w *watcher) run(ctx context.Context, initial <-chan error) error {
+	tick := w.debounce / 2
+	if tick <= 0 {
+		tick = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	ready := false
+	for {
+		select {
+		case <-ctx.Done():
+			if initial != nil {
+				// The initial run stops at the cancellation, and its manifest and report are saved before it returns
+				if err := w.start(<-initial); err != nil {
+					return err
+				}
+			}
+			// The last changes are indexed with a new context, since ctx is already cancelled
+			w.flush(context.Background(), time.Now(), true)
+			log.Printf("Stopped watching %s: %s", w.root, &w.pipeline.stats)
+			if err := w.saveManifest(time.Now(), true); err != nil {
+				return fmt.Errorf("error saving manifest: %w", err)
+			}
+			return nil
+		case err := <-initial:
+			if err := w.start(err); err != nil {
+				return err
+			}
+			ready = true
+			initial = nil
+			log.Printf("Watching %s for new emails", w.root)
+		case event, ok := <-w.events.Events:
+			if !ok {
+				return nil
+			}
+			w.handle(event, time.Now())
+		case err, ok := <-w.events.Errors:
+			if !ok {
+				return nil
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				log.Printf("Events were lost, run with -incremental to index the emails that were missed")
+				continue
+			}
+			log.Printf("Error watching %s: %v", w.root, err)
+		case now := <-ticker.C:
+			if !ready {
+				continue
+			}
+			w.flush(ctx, now, false)
+			if err := w.saveManifest(now, false); err != nil {
+				log.Printf("Error saving manifest, it is tried again later: %v", err)
+			}
+		}
+	}
+}
+
+// start prepares the watcher to index changes once the initial run returned err, which is returned if not nil
+func (w *watcher) start(err error) error {
+	if err != nil || w.manifestPath == "" {
+		return err
+	}
+	w.pipeline.manifest, err = loadManifest(w.manifestPath)
+	return err
+}
+
+// saveManifest saves the manifest if it changed, unless it was saved less than manifestSaveInterval ago and
+// force is not set
+func (w *watcher) saveManifest(now time.Time, force bool) error {
+	if w.pipeline.manifest == nil || !w.unsaved || (!force && now.Sub(w.saved) < manifestSaveInterval) {
+		return nil
+	}
+	if err := w.pipeline.manifest.save(); err != nil {
+		return err
+	}
+	w.saved, w.unsaved = now, false
+	return nil
+}
+
+// Close stops watching the maildir
+func (w *watcher) Close() error {
+	return w.events.Close()
+}
+
+// watchMaildir indexes the emails of a maildir like processMaildir, then keeps indexing the emails delivered,
+// changed, moved or deleted until ctx is cancelled
+func watchMaildir(ctx context.Context, maildir string, opts Options) (err error) {
+	info, err := os.Stat(maildir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || opts.Format == FormatMbox {
+		return fmt.Errorf("watch mode only supports maildir directories")
+	}
+	if opts.Versioned {
+		return fmt.Errorf("watch mode does not support versioned indexes")
+	}
+
+	sink, err := newSink(opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := sink.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("error closing sink: %w", closeErr)
+		}
+	}()
+	deadLetterPath := opts.DeadLetterPath
+	if deadLetterPath == "" {
+		deadLetterPath = filepath.Clean(maildir) + deadLetterSuffix
+	}
+	deadLetters := newDeadLetters(deadLetterPath)
+	defer deadLetters.Close()
+
+	// The maildir is watched before the initial run, so no email delivered during the run is missed
+	w, err := newWatcher(filepath.Clean(maildir), sink, deadLetters, opts)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if opts.Incremental {
+		w.manifestPath = opts.ManifestPath
+		if w.manifestPath == "" {
+			w.manifestPath = defaultManifestPath(maildir)
+		}
+	}
+	// The initial run writes to the sink of the watcher, so a file sink is created only once
+	initial := make(chan error, 1)
+	go func() {
+		initial <- processMaildir(ctx, maildir, opts, sink)
+	}()
+	return w.run(ctx, initial)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// recordingSink keeps the emails written to it and the paths whose documents were deleted
+type recordingSink struct {
+	mu      sync.Mutex
+	written []*EmailJson
+	deleted []string
+}
+
+func (s *recordingSink) Write(ctx context.Context, emails []*EmailJson) ([]recordError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, emails...)
+	return nil, nil
+}
+
+func (s *recordingSink) DeleteSource(ctx context.Context, path string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, path)
+	return 1, nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+// writtenPaths returns the sorted source paths of the emails written to the sink
+func (s *recordingSink) writtenPaths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for _, email := range s.written {
+		paths = append(paths, email.SourcePath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// newTestMaildir creates a Maildir folder with its cur, new and tmp directories
+func newTestMaildir(t *testing.T) string {
+	root, _ := ioutil.TempDir("", "watch")
+	for _, dir := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, "allen-p", "inbox", dir), 0755); err != nil {
+			t.Fatalf("error creating maildir: %v", err)
+		}
+	}
+	return root
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	root := newTestMaildir(t)
+	defer os.RemoveAll(root)
+	sink := &recordingSink{}
+	opts := DefaultOptions()
+	opts.WatchDebounce = time.Second
+	w, err := newWatcher(root, sink, nil, opts)
+	if err != nil {
+		t.Fatalf("newWatcher returned an error: %v", err)
+	}
+	defer w.Close()
+
+	inbox := filepath.Join(root, "allen-p", "inbox")
+	delivered := filepath.Join(inbox, "new", "1.host")
+	read := filepath.Join(inbox, "cur", "1.host:2,S")
+	ioutil.WriteFile(read, []byte("Message-ID: <1@example.com>\nSubject: Hello\n\nbody"), 0644)
+	start := time.Now()
+
+	// A delivery that is read right away: the writes are coalesced and the move replaces the new path
+	w.handle(fsnotify.Event{Name: delivered, Op: fsnotify.Create}, start)
+	w.handle(fsnotify.Event{Name: delivered, Op: fsnotify.Write}, start)
+	w.handle(fsnotify.Event{Name: delivered, Op: fsnotify.Rename}, start.Add(500*time.Millisecond))
+	w.handle(fsnotify.Event{Name: read, Op: fsnotify.Create}, start.Add(500*time.Millisecond))
+	w.handle(fsnotify.Event{Name: filepath.Join(inbox, "tmp", "2.host"), Op: fsnotify.Create}, start)
+	w.handle(fsnotify.Event{Name: filepath.Join(inbox, "cur", ".lock"), Op: fsnotify.Create}, start)
+	if len(w.pending) != 2 {
+		t.Errorf("the watcher did not ignore the tmp and hidden files. Got: %d pending changes, expected: 2", len(w.pending))
+	}
+
+	w.flush(context.Background(), start.Add(time.Second), false)
+	if len(sink.written) != 0 || len(sink.deleted) != 0 {
+		t.Errorf("the watcher indexed a change before the debounce delay")
+	}
+	w.flush(context.Background(), start.Add(1500*time.Millisecond), false)
+	if paths := sink.writtenPaths(); !reflect.DeepEqual(paths, []string{read}) {
+		t.Errorf("the watcher did not index the read email. Got: %v", paths)
+	}
+	if !reflect.DeepEqual(sink.deleted, []string{delivered}) {
+		t.Errorf("the watcher did not delete the documents of the moved email. Got: %v", sink.deleted)
+	}
+	if email := sink.written[0]; !email.Seen || email.Owner != "allen-p" || email.FolderPath != "allen-p/inbox" {
+		t.Errorf("the watcher did not set the mailbox fields. Got: %v, %s, %s", email.Seen, email.Owner, email.FolderPath)
+	}
+	if len(w.pending) != 0 {
+		t.Errorf("the watcher kept indexed changes. Got: %d pending changes", len(w.pending))
+	}
+}
+
+func TestWatcherModified(t *testing.T) {
+	root := newTestMaildir(t)
+	defer os.RemoveAll(root)
+	sink := &recordingSink{}
+	w, err := newWatcher(root, sink, nil, DefaultOptions())
+	if err != nil {
+		t.Fatalf("newWatcher returned an error: %v", err)
+	}
+	defer w.Close()
+
+	// A file written in place may already be indexed, so its old documents are replaced
+	path := filepath.Join(root, "allen-p", "inbox", "cur", "1.host:2,")
+	ioutil.WriteFile(path, []byte("Subject: Edited\n\nbody"), 0644)
+	w.handle(fsnotify.Event{Name: path, Op: fsnotify.Write}, time.Now())
+	w.flush(context.Background(), time.Now(), true)
+	if !reflect.DeepEqual(sink.deleted, []string{path}) || !reflect.DeepEqual(sink.writtenPaths(), []string{path}) {
+		t.Errorf("the watcher did not replace the modified email. Got deleted: %v, written: %v", sink.deleted, sink.writtenPaths())
+	}
+}
+
+func TestWatcherRun(t *testing.T) {
+	root := newTestMaildir(t)
+	defer os.RemoveAll(root)
+	sink := &recordingSink{}
+	opts := DefaultOptions()
+	opts.WatchDebounce = 50 * time.Millisecond
+	w, err := newWatcher(root, sink, nil, opts)
+	if err != nil {
+		t.Fatalf("newWatcher returned an error: %v", err)
+	}
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	initial := make(chan error, 1)
+	initial <- nil
+	done := make(chan error)
+	go func() {
+		done <- w.run(ctx, initial)
+	}()
+
+	// A folder created while watching is watched and its emails are indexed
+	folder := filepath.Join(root, "allen-p", "sent")
+	os.MkdirAll(folder, 0755)
+	time.Sleep(100 * time.Millisecond)
+	path := filepath.Join(folder, "1.")
+	ioutil.WriteFile(path, []byte("Subject: Sent\n\nbody"), 0644)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.writtenPaths()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run returned an error: %v", err)
+	}
+	if paths := sink.writtenPaths(); !reflect.DeepEqual(paths, []string{path}) {
+		t.Errorf("the watcher did not index the delivered email. Got: %v, expected: %v", paths, []string{path})
+	}
+}
+
+func TestWatcherRunCancelledBeforeInitial(t *testing.T) {
+	root := newTestMaildir(t)
+	defer os.RemoveAll(root)
+	w, err := newWatcher(root, &recordingSink{}, nil, DefaultOptions())
+	if err != nil {
+		t.Fatalf("newWatcher returned an error: %v", err)
+	}
+	defer w.Close()
+
+	// run waits for the initial run to stop and returns its error instead of reporting success
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	initial := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		initial <- ctx.Err()
+	}()
+	if err := w.run(ctx, initial); !errors.Is(err, context.Canceled) {
+		t.Errorf("run did not return the error of the interrupted initial run. Got: %v", err)
+	}
+}
+
+func TestWatchMaildirFileSink(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "watch")
+	defer os.RemoveAll(tempDir)
+	root := filepath.Join(tempDir, "maildir")
+	inbox := filepath.Join(root, "allen-p", "inbox")
+	os.MkdirAll(inbox, 0755)
+	ioutil.WriteFile(filepath.Join(inbox, "1."), []byte("Subject: First\n\nbody"), 0644)
+
+	opts := DefaultOptions()
+	opts.Sink = SinkFile
+	opts.Output = filepath.Join(tempDir, "emails.ndjson")
+	opts.WatchDebounce = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- watchMaildir(ctx, root, opts)
+	}()
+
+	// The initial run and the watcher write to the same file, so the email of the initial run is not overwritten
+	time.Sleep(300 * time.Millisecond)
+	ioutil.WriteFile(filepath.Join(inbox, "2."), []byte("Subject: Second\n\nbody"), 0644)
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("watchMaildir returned an error: %v", err)
+	}
+	data, err := ioutil.ReadFile(opts.Output)
+	if err != nil {
+		t.Fatalf("the output file was not written: %v", err)
+	}
+	for _, subject := range []string{"First", "Second"} {
+		if !strings.Contains(string(data), `"subject":"`+subject+`"`) {
+			t.Errorf("the output file does not hold the email %s. Got: %s", subject, data)
+		}
+	}
+}
+
+func TestWatcherRunManifest(t *testing.T) {
+	root := newTestMaildir(t)
+	defer os.RemoveAll(root)
+	inbox := filepath.Join(root, "allen-p", "inbox", "cur")
+	removed := filepath.Join(inbox, "1.")
+	ioutil.WriteFile(removed, []byte("Subject: Old\n\nbody"), 0644)
+	manifestPath := root + manifestSuffix
+	defer os.Remove(manifestPath)
+	manifest := newManifest(manifestPath)
+	manifest.track(removed)
+	manifest.acknowledge([]*EmailJson{{SourcePath: removed}})
+	if err := manifest.save(); err != nil {
+		t.Fatalf("save returned an error: %v", err)
+	}
+
+	sink := &recordingSink{}
+	opts := DefaultOptions()
+	opts.WatchDebounce = 50 * time.Millisecond
+	w, err := newWatcher(root, sink, nil, opts)
+	if err != nil {
+		t.Fatalf("newWatcher returned an error: %v", err)
+	}
+	defer w.Close()
+	w.manifestPath = manifestPath
+
+	ctx, cancel := context.WithCancel(context.Background())
+	initial := make(chan error, 1)
+	initial <- nil
+	done := make(chan error)
+	go func() {
+		done <- w.run(ctx, initial)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.Remove(removed)
+	delivered := filepath.Join(inbox, "2.")
+	ioutil.WriteFile(delivered, []byte("Subject: New\n\nbody"), 0644)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.writtenPaths()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run returned an error: %v", err)
+	}
+
+	// The manifest is saved on shutdown with the changes indexed while watching, so a restart skips them
+	saved, err := loadManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("loadManifest returned an error: %v", err)
+	}
+	if _, ok := saved.Files[delivered]; !ok {
+		t.Errorf("the delivered email was not added to the manifest. Got: %v", saved.Files)
+	}
+	if _, ok := saved.Files[removed]; ok {
+		t.Errorf("the deleted email was not removed from the manifest. Got: %v", saved.Files)
+	}
+}
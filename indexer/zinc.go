@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// zincSourceHits is the part of a Zinc search response needed to find documents by source path
+type zincSourceHits struct {
+	Hits struct {
+		Hits []struct {
+			ID     string `json:"_id"`
+			Source struct {
+				SourcePath string `json:"source_path"`
+			} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// zincRequest sends a request with the given credentials to the Zinc API and checks the status code.
+// If out is not nil the JSON response is decoded into it.
+func zincRequest(ctx context.Context, auth credentials, method, url string, body interface{}, out interface{}) error {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	auth.setAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %w", method, url, newStatusError(resp))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// zincThreadHits is the part of a Zinc search response needed to place an email in a thread
+type zincThreadHits struct {
+	Hits struct {
+		Hits []struct {
+			ID     string `json:"_id"`
+			Source struct {
+				Subject        string `json:"subject"`
+				ThreadID       string `json:"thread_id"`
+				ThreadPosition *int   `json:"thread_position"`
+			} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// searchIndexedEmails runs a search on the index and returns the emails found, in the order of the hits
+func searchIndexedEmails(ctx context.Context, zincURL, index string, auth credentials, query map[string]interface{}) ([]indexedEmail, error) {
+	var hits zincThreadHits
+	if err := zincRequest(ctx, auth, "POST", zincURL+"/"+index+"/_search", query, &hits); err != nil {
+		return nil, err
+	}
+	found := make([]indexedEmail, 0, len(hits.Hits.Hits))
+	for _, hit := range hits.Hits.Hits {
+		found = append(found, indexedEmail{ID: hit.ID, ThreadID: hit.Source.ThreadID, Subject: hit.Source.Subject})
+	}
+	return found, nil
+}
+
+// deleteBySourcePath deletes every document of the index that was parsed from the given file
+// and returns how many were deleted
+func deleteBySourcePath(ctx context.Context, zincURL, index string, auth credentials, path string) (int, error) {
+	query := map[string]interface{}{
+		"search_type": "matchphrase",
+		"query": map[string]string{
+			"term":  path,
+			"field": "source_path",
+		},
+		"_source":     []string{"source_path"},
+		"max_results": 1000,
+	}
+	var hits zincSourceHits
+	if err := zincRequest(ctx, auth, "POST", zincURL+"/"+index+"/_search", query, &hits); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, hit := range hits.Hits.Hits {
+		// The phrase query can also match longer paths, so only exact matches are deleted
+		if hit.Source.SourcePath != path {
+			continue
+		}
+		if err := zincRequest(ctx, auth, "DELETE", zincURL+"/"+index+"/_doc/"+url.PathEscape(hit.ID), nil, nil); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// zincESURL returns the base URL of the Elasticsearch compatible API of the Zinc server whose API is at zincURL
+func zincESURL(zincURL string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(zincURL, "/"), "/api") + "/es"
+}
+
+// countDocuments returns the number of documents in the index
+func countDocuments(ctx context.Context, zincURL, index string, auth credentials) (int, error) {
+	query := map[string]interface{}{
+		"search_type": "matchall",
+		"_source":     []string{},
+		"max_results": 1,
+	}
+	var response struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+		} `json:"hits"`
+	}
+	if err := zincRequest(ctx, auth, "POST", zincURL+"/"+index+"/_search", query, &response); err != nil {
+		return 0, err
+	}
+	return response.Hits.Total.Value, nil
+}
+
+// listIndexes returns the names of the indexes that start with prefix
+func listIndexes(ctx context.Context, zincURL, prefix string, auth credentials) ([]string, error) {
+	var names []string
+	if err := zincRequest(ctx, auth, "GET", zincURL+"/index_name?name="+url.QueryEscape(prefix), nil, &names); err != nil {
+		return nil, err
+	}
+	matching := names[:0]
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			matching = append(matching, name)
+		}
+	}
+	return matching, nil
+}
+
+// aliasAction is an action of an Elasticsearch compatible _aliases request
+type aliasAction struct {
+	Index     string `json:"index"`
+	Alias     string `json:"alias"`
+	MustExist *bool  `json:"must_exist,omitempty"`
+}
+
+// switchAlias points the alias at index, removes it from the previous indexes and adds index to the history
+// alias, in a single request so searches on the alias never see an empty or partial index
+func switchAlias(ctx context.Context, zincURL, alias, history, index string, previous []string, auth credentials) error {
+	mustExist := false
+	actions := make([]map[string]aliasAction, 0, len(previous)+2)
+	for _, old := range previous {
+		actions = append(actions, map[string]aliasAction{"remove": {Index: old, Alias: alias, MustExist: &mustExist}})
+	}
+	actions = append(actions, map[string]aliasAction{"add": {Index: index, Alias: alias}})
+	actions = append(actions, map[string]aliasAction{"add": {Index: index, Alias: history}})
+	body := map[string]interface{}{"actions": actions}
+	return zincRequest(ctx, auth, "POST", zincESURL(zincURL)+"/_aliases", body, nil)
+}
+
+// aliasIndexes returns the sorted names of the indexes the alias points at, none if the alias does not exist
+func aliasIndexes(ctx context.Context, zincURL, alias string, auth credentials) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", zincESURL(zincURL)+"/_alias/"+url.PathEscape(alias), nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.setAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status code getting alias %s: %d", alias, resp.StatusCode)
+	}
+	// The response maps the name of every index to its aliases
+	var indexes map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&indexes); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// deleteIndex deletes the index and its documents
+func deleteIndex(ctx context.Context, zincURL, index string, auth credentials) error {
+	return zincRequest(ctx, auth, "DELETE", zincURL+"/index/"+index, nil, nil)
+}
@@ -30,9 +30,13 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		perPage = 10
 	}
 
-	search := search.NewSearch()
+	s := search.NewSearch()
+	// original=true only searches the text written by the authors, leaving out quoted replies and forwarded messages
+	if original, _ := strconv.ParseBool(r.URL.Query().Get("original")); original {
+		s = s.WithField(search.OriginalContentField)
+	}
 
-	results, err := search.PerformSearch(query, page, perPage)
+	results, err := s.PerformSearch(query, page, perPage)
 	if err != nil {
 		log.Printf("Error: %v", err)
 		return
@@ -8,6 +8,10 @@ import (
 	"net/http"
 )
 
+// OriginalContentField is the field holding the text written by the author of an email,
+// without the quoted replies, signature and forwarded messages
+const OriginalContentField = "body_new"
+
 // Search struct is used to search emails that match the given query
 type Search struct {
 	// searchEndpoint is the endpoint where the search request is sent
@@ -16,6 +20,8 @@ type Search struct {
 	authUsername string
 	// authPassword is the password used for basic auth
 	authPassword string
+	// field, if not empty, is the only field the query is matched against
+	field string
 }
 
 // NewSearch returns a new instance of Search struct with the default values
@@ -27,6 +33,13 @@ func NewSearch() *Search {
 	}
 }
 
+// WithField returns a copy of the Search that only matches the query against the given field
+func (s *Search) WithField(field string) *Search {
+	search := *s
+	search.field = field
+	return &search
+}
+
 // ZincSearchRequest represents the body of a search request to Zincsearch
 type ZincSearchRequest struct {
 	SearchType string            `json:"search_type"`
@@ -35,18 +48,29 @@ type ZincSearchRequest struct {
 	MaxResults int               `json:"max_results"`
 }
 
+// ZincEmailSource represents the fields of an indexed email returned in a search hit
+type ZincEmailSource struct {
+	Header        map[string][]string `json:"header"`
+	Body          string              `json:"body"`
+	XFromNames    []string            `json:"x_from_names"`
+	XToNames      []string            `json:"x_to_names"`
+	Folder        string              `json:"folder"`
+	OriginMailbox string              `json:"origin_mailbox"`
+}
+
+// ZincSearchHit represents an email that matches a search request
+type ZincSearchHit struct {
+	ID     string          `json:"_id"`
+	Source ZincEmailSource `json:"_source"`
+}
+
 // ZincSearchResponse represents the response from a search request to Zincsearch
 type ZincSearchResponse struct {
 	Hits struct {
 		Total struct {
 			Value int `json:"value"`
 		} `json:"total"`
-		Hits []struct {
-			Source struct {
-				Header map[string][]string `json:"header"`
-				Body   string              `json:"body"`
-			} `json:"_source"`
-		} `json:"hits"`
+		Hits []ZincSearchHit `json:"hits"`
 	} `json:"hits"`
 }
 
@@ -60,10 +84,17 @@ type EmailSearchResponse struct {
 
 // Email represents an email
 type Email struct {
+	ID      string   `json:"id"`
 	Subject string   `json:"subject"`
 	From    string   `json:"from"`
 	To      []string `json:"to"`
 	Body    string   `json:"body"`
+	// XFromNames and XToNames are the names of the sender and recipients, Folder and OriginMailbox the folder and
+	// the custodian's mailbox the email was exported from, when the email has the X- headers of the Enron corpus
+	XFromNames    []string `json:"x_from_names,omitempty"`
+	XToNames      []string `json:"x_to_names,omitempty"`
+	Folder        string   `json:"folder,omitempty"`
+	OriginMailbox string   `json:"origin_mailbox,omitempty"`
 }
 
 // createSearchRequest creates an HTTP request for a search with the given query and page/perPage parameters
@@ -76,6 +107,11 @@ func (s *Search) createSearchRequest(query string, page, perPage int) (*http.Req
 		From:       (page - 1) * perPage,
 		MaxResults: perPage,
 	}
+	if s.field != "" {
+		// A query string searches every field, a match query searches a single one
+		reqBody.SearchType = "match"
+		reqBody.Query["field"] = s.field
+	}
 
 	reqBytes, err := json.Marshal(reqBody)
 	if err != nil {
@@ -101,10 +137,15 @@ func (s *Search) mapZincResponseToEmailSearchResponse(zincResponse ZincSearchRes
 	searchResults.Size = perPage
 	searchResults.Emails = make([]Email, len(zincResponse.Hits.Hits))
 	for i, hit := range zincResponse.Hits.Hits {
+		searchResults.Emails[i].ID = hit.ID
 		searchResults.Emails[i].Subject = hit.Source.Header["Subject"][0]
 		searchResults.Emails[i].From = hit.Source.Header["From"][0]
 		searchResults.Emails[i].To = hit.Source.Header["To"]
 		searchResults.Emails[i].Body = hit.Source.Body
+		searchResults.Emails[i].XFromNames = hit.Source.XFromNames
+		searchResults.Emails[i].XToNames = hit.Source.XToNames
+		searchResults.Emails[i].Folder = hit.Source.Folder
+		searchResults.Emails[i].OriginMailbox = hit.Source.OriginMailbox
 	}
 	return searchResults, nil
 }
@@ -27,6 +27,23 @@ func TestCreateSearchRequest(t *testing.T) {
 	}
 }
 
+func TestCreateSearchRequestWithField(t *testing.T) {
+	s := NewSearch().WithField(OriginalContentField)
+
+	req, err := s.createSearchRequest("test query", 2, 10)
+	if err != nil {
+		t.Errorf("Error creating search request: %v", err)
+	}
+	var body ZincSearchRequest
+	json.NewDecoder(req.Body).Decode(&body)
+	if body.SearchType != "match" || body.Query["field"] != "body_new" || body.Query["term"] != "test query" {
+		t.Errorf("Expected a match query on body_new, got %+v", body)
+	}
+	if body.From != 10 {
+		t.Errorf("Expected from to be 10, got %d", body.From)
+	}
+}
+
 func TestMapZincResponseToEmailSearchResponse(t *testing.T) {
 	// Create a new search client
 	s := NewSearch()
@@ -34,23 +51,20 @@ func TestMapZincResponseToEmailSearchResponse(t *testing.T) {
 	// Test mapping a valid ZincSearchResponse
 	zincResp := ZincSearchResponse{}
 	zincResp.Hits.Total.Value = 1
-	zincResp.Hits.Hits = []struct {
-		Source struct {
-			Header map[string][]string `json:"header"`
-			Body   string              `json:"body"`
-		} `json:"_source"`
-	}{
+	zincResp.Hits.Hits = []ZincSearchHit{
 		{
-			Source: struct {
-				Header map[string][]string `json:"header"`
-				Body   string              `json:"body"`
-			}{
+			ID: "test-id",
+			Source: ZincEmailSource{
 				Header: map[string][]string{
 					"Subject": {"Test Subject"},
 					"From":    {"test@example.com"},
 					"To":      {"recipient@example.com"},
 				},
-				Body: "Test body",
+				Body:          "Test body",
+				XFromNames:    []string{"Phillip K Allen"},
+				XToNames:      []string{"Tim Belden", "Mike Grigsby"},
+				Folder:        "sent mail",
+				OriginMailbox: "allen-p",
 			},
 		},
 	}
@@ -61,6 +75,9 @@ func TestMapZincResponseToEmailSearchResponse(t *testing.T) {
 	if len(resp.Emails) != 1 {
 		t.Errorf("Expected 1 email, got %d", len(resp.Emails))
 	}
+	if resp.Emails[0].ID != "test-id" {
+		t.Errorf("Expected email id to be 'test-id', got %s", resp.Emails[0].ID)
+	}
 	if resp.Emails[0].Subject != "Test Subject" {
 		t.Errorf("Expected email subject to be 'Test Subject', got %s", resp.Emails[0].Subject)
 	}
@@ -73,6 +90,12 @@ func TestMapZincResponseToEmailSearchResponse(t *testing.T) {
 	if resp.Emails[0].Body != "Test body" {
 		t.Errorf("Expected email body to be 'Test body', got %s", resp.Emails[0].Body)
 	}
+	if len(resp.Emails[0].XFromNames) != 1 || resp.Emails[0].XFromNames[0] != "Phillip K Allen" || len(resp.Emails[0].XToNames) != 2 {
+		t.Errorf("Expected the X-From and X-To names, got %v, %v", resp.Emails[0].XFromNames, resp.Emails[0].XToNames)
+	}
+	if resp.Emails[0].Folder != "sent mail" || resp.Emails[0].OriginMailbox != "allen-p" {
+		t.Errorf("Expected folder 'sent mail' and origin mailbox 'allen-p', got %s, %s", resp.Emails[0].Folder, resp.Emails[0].OriginMailbox)
+	}
 
 	// Test mapping a ZincSearchResponse with no hits
 	zincResp.Hits.Total.Value = 0
@@ -97,17 +120,10 @@ func TestPerformSearch(t *testing.T) {
 
 		resp := ZincSearchResponse{}
 		resp.Hits.Total.Value = 1
-		resp.Hits.Hits = []struct {
-			Source struct {
-				Header map[string][]string `json:"header"`
-				Body   string              `json:"body"`
-			} `json:"_source"`
-		}{
+		resp.Hits.Hits = []ZincSearchHit{
 			{
-				Source: struct {
-					Header map[string][]string `json:"header"`
-					Body   string              `json:"body"`
-				}{
+				ID: "test-id",
+				Source: ZincEmailSource{
 					Header: map[string][]string{
 						"Subject": {"Test Subject"},
 						"From":    {"test@example.com"},